@@ -1,6 +1,8 @@
 package dsc
 
 import (
+	"time"
+
 	"github.com/hashicorp/packer/common"
 	"github.com/hashicorp/packer/template/interpolate"
 )
@@ -12,14 +14,32 @@ type Config struct {
 	// The command used to execute Puppet.
 	ExecuteCommand string `mapstructure:"execute_command"`
 
+	// An array of environment variables that will be injected before
+	// the DSC Configuration is run.
+	Vars []string `mapstructure:"environment_vars"`
+
+	// If true, PACKER_BUILD_NAME and PACKER_BUILDER_TYPE are not set
+	// along with Vars.
+	SkipPackerVars bool `mapstructure:"skip_packer_vars"`
+
+	// A local file of environment variables, one key=value pair per
+	// line, merged with Vars. Lines beginning with # are ignored.
+	VarsFile string `mapstructure:"environment_vars_file"`
+
 	// Set of Parameters to pass to the DSC Configuration.
 	ConfigurationParams map[string]string `mapstructure:"configuration_params"`
 
-	// Relative path to a folder, containing the pre-generated MOF file.
+	// Relative path to a pre-generated MOF file, or a folder containing
+	// pre-generated MOF files. Mutually exclusive with ManifestFile.
 	//
 	// Path is relative to the folder containing the Packer json.
 	MofPath string `mapstructure:"mof_path"`
 
+	// Pre-generated partial configurations, registered with the Local
+	// Configuration Manager and applied together. They are published
+	// in the order given. Mutually exclusive with ManifestFile and MofPath.
+	PartialConfigurations []PartialConfiguration `mapstructure:"partial_configurations"`
+
 	// Relative path to the DSC Configuration Data file.
 	//
 	// Configuration data is used to parameterise the configuration_file.
@@ -33,11 +53,29 @@ type Config struct {
 	// Path is relative to the folder containing the Packer json.
 	ManifestDir string `mapstructure:"manifest_dir"`
 
+	// Path to a directory of PowerShell scripts, such as partial
+	// configurations, that are dot-sourced before the manifest.
+	//
+	// Every .ps1 file in the tree is uploaded, preserving its structure.
+	ScriptDir string `mapstructure:"script_dir"`
+
 	// The main DSC manifest file to apply to kick off the entire thing.
 	//
 	// Path is relative to the folder containing the Packer json.
 	ManifestFile string `mapstructure:"manifest_file"`
 
+	// Manifest files applied in sequence, stopping at the first to fail.
+	// Each is compiled into its own directory, and the name of each
+	// Configuration is the base name of its file. Mutually exclusive with
+	// ManifestFile.
+	//
+	// Paths are relative to the folder containing the Packer json.
+	ManifestFiles []string `mapstructure:"manifest_files"`
+
+	// The contents of the DSC manifest, for Configurations generated by
+	// the template rather than kept in a file. Requires ConfigurationName.
+	InlineManifest string `mapstructure:"inline_manifest"`
+
 	// The name of the Configuration module
 	//
 	// Defaults to the basename of the "configuration_file"
@@ -62,23 +100,239 @@ type Config struct {
 	// Modules to install, using the latest PackageManagement tooling
 	// e.g. { "xWebAdministration": "1.0.0.0" }
 	//
+	// An empty version installs the latest available module.
+	//
 	// See InstallPackageManagement if
 	InstallModules map[string]string `mapstructure:"install_modules"`
 
+	// The remote directory that scripts are uploaded to, and that
+	// contains the staging directory by default. It is created if it
+	// doesn't exist. Defaults to /tmp.
+	TempDir string `mapstructure:"temp_dir"`
+
 	// The directory where files will be uploaded. Packer requires write
 	// permissions in this directory.
 	StagingDir string `mapstructure:"staging_dir"`
 
-	// If true, staging directory is removed after executing dsc.
+	// If true, staging directory is removed after executing dsc, along
+	// with the scripts uploaded to run it.
 	CleanStagingDir bool `mapstructure:"clean_staging_dir"`
 
+	// If true, the files and directories Packer created within the
+	// staging directory, the compiled MOF and the uploaded scripts are
+	// removed after executing dsc. Defaults to true.
+	CleanupRemotePath bool `mapstructure:"cleanup_remote_path"`
+
+	// If true, staging directory and uploaded scripts are removed if
+	// provisioning fails, so that configuration data isn't left behind.
+	CleanupOnFailure bool `mapstructure:"cleanup_on_failure"`
+
 	// The directory from which the command will be executed.
 	// Packer requires the directory to exist when running dsc.
 	WorkingDir string `mapstructure:"working_dir"`
 
+	// The PowerShell executable used to run commands on the remote host,
+	// e.g. pwsh to use PowerShell 7. Defaults to powershell.
+	PowerShellExecutable string `mapstructure:"powershell_executable"`
+
+	// The PowerShell execution policy used to run scripts.
+	// Defaults to "Bypass".
+	ExecutionPolicy string `mapstructure:"execution_policy"`
+
+	// If true, output from the remote machine is streamed to the UI as
+	// it is received. Otherwise it is only shown if a command fails.
+	// Defaults to true.
+	ShowProgress bool `mapstructure:"show_progress"`
+
+	// If true, DSC is run with -Verbose, reporting the progress of each
+	// resource. Defaults to true.
+	Verbose bool `mapstructure:"verbose"`
+
+	// If true, debug messages from DSC resources are shown, and the
+	// rendered DSC runner and MOF path are written to the Packer log.
+	Debug bool `mapstructure:"debug"`
+
+	// The names of environment_vars and configuration_params whose
+	// values are redacted from the Packer log.
+	SensitiveVars []string `mapstructure:"sensitive_vars"`
+
+	// The least severe messages written to the Packer log, one of debug,
+	// info or warn. Defaults to info.
+	LogLevel string `mapstructure:"log_level"`
+
+	// If true, the SHA256 hash of each file uploaded is checked against
+	// the local file, retrying the upload if they differ. Defaults to true.
+	VerifyUpload bool `mapstructure:"verify_upload"`
+
+	// If true, scripts are uploaded as-is. Otherwise their line endings
+	// are converted to CRLF for Windows.
+	Binary bool `mapstructure:"binary"`
+
+	// If true, files are uploaded in chunks that are appended to on the
+	// remote host. Files larger than 10MB are always chunked.
+	ChunkedUpload bool `mapstructure:"chunked_upload"`
+
+	// PowerShell commands run before anything is installed or DSC is
+	// configured, such as disabling a service.
+	PreApplyInline []string `mapstructure:"pre_apply_inline"`
+
+	// Path to a local PowerShell script run after pre_apply_inline.
+	PreApplyScript string `mapstructure:"pre_apply_script"`
+
+	// A PowerShell command run once everything is uploaded, immediately
+	// before DSC is run.
+	PreExecuteCommand string `mapstructure:"pre_execute_command"`
+
+	// A PowerShell command run once DSC has run.
+	PostExecuteCommand string `mapstructure:"post_execute_command"`
+
+	// If true, post_execute_command is also run when DSC fails.
+	RunPostOnFailure bool `mapstructure:"run_post_on_failure"`
+
+	// If true, any Configuration left pending by an earlier DSC run is
+	// removed before the Configuration is applied.
+	ClearPendingConfiguration bool `mapstructure:"clear_pending_configuration"`
+
+	// If true, Test-DscConfiguration is run once the Configuration has
+	// been applied, failing if the node isn't in the desired state.
+	VerifyAfterApply bool `mapstructure:"verify_after_apply"`
+
+	// If true, provisioning fails if DSC made no changes because the
+	// node was already in the desired state.
+	FailIfNoChanges bool `mapstructure:"fail_if_no_changes"`
+
+	// If true, the status of the DSC run is reported using
+	// Get-DscConfigurationStatus, failing if the status is Failure.
+	// Defaults to true.
+	ReportStatus bool `mapstructure:"report_status"`
+
+	// The format report_status reports the status in, either text or
+	// json. Defaults to text.
+	StatusOutputFormat string `mapstructure:"status_output_format"`
+
+	// The minimum version of PowerShell required on the remote host,
+	// e.g. 5.0. Provisioning fails before anything is uploaded if an
+	// older version is installed.
+	MinPowerShellVersion string `mapstructure:"min_powershell_version"`
+
+	// If true, the check that the PSDesiredStateConfiguration module is
+	// available on the remote host is skipped.
+	SkipPreflight bool `mapstructure:"skip_preflight"`
+
+	// If true, the Configuration is run with -WhatIf, reporting the
+	// changes DSC would make without making them.
+	WhatIf bool `mapstructure:"what_if"`
+
+	// A local path to save the status of the DSC run to, as reported
+	// by Get-DscConfigurationStatus in JSON.
+	ReportPath string `mapstructure:"report_path"`
+
+	// A local path to save the current state of the resources in the
+	// Configuration to once it has been applied, as reported by
+	// Get-DscConfiguration in JSON.
+	StatePath string `mapstructure:"state_path"`
+
+	// A local path to write a JSON summary of the provisioning run to,
+	// whether or not it succeeds.
+	OutputJSON string `mapstructure:"output_json"`
+
+	// The remote directory the Configuration is compiled into, and
+	// applied from. Defaults to the staging directory within WorkingDir.
+	MofOutputPath string `mapstructure:"mof_output_path"`
+
+	// A local directory to download the compiled MOF files to, for
+	// inspection or archiving. It is created if it doesn't exist.
+	OutputMofDirectory string `mapstructure:"output_mof_directory"`
+
+	// The exit statuses of a dsc run treated as success, e.g. 3010 when
+	// a reboot is required. Defaults to 0 and 2.
+	ValidExitCodes []int `mapstructure:"valid_exit_codes"`
+
 	// If true, packer will ignore all exit-codes from a dsc run
 	IgnoreExitCodes bool `mapstructure:"ignore_exit_codes"`
 
+	// Settings to apply to the Local Configuration Manager prior to
+	// running the Configuration.
+	// e.g. { "ConfigurationMode": "ApplyAndAutoCorrect" }
+	//
+	// See lcmSettings for the supported settings and their values.
+	LocalConfigurationManager map[string]string `mapstructure:"local_configuration_manager"`
+
+	// Instructs the communicator to run DSC as a Windows scheduled
+	// task, effectively elevating the remote user by impersonating
+	// a logged-in user
+	ElevatedUser     string `mapstructure:"elevated_user"`
+	ElevatedPassword string `mapstructure:"elevated_password"`
+
+	// If true, reboots requested by DSC resources are performed and the
+	// Configuration is resumed once the machine is available again.
+	RebootNodeIfNeeded bool `mapstructure:"reboot_node_if_needed"`
+
+	// The timeout for retrying to start a process. Until this timeout
+	// is reached, if the provisioner can't start a process, it retries.
+	// This can be set high to allow for reboots.
+	StartRetryTimeout time.Duration `mapstructure:"start_retry_timeout"`
+
+	// The maximum number of attempts made before giving up, even if
+	// start_retry_timeout hasn't been reached. Zero, the default, means
+	// attempts are only limited by start_retry_timeout.
+	MaxRetries int `mapstructure:"max_retries"`
+
+	// The time to wait between retries. Defaults to 2s.
+	RetryInterval time.Duration `mapstructure:"retry_interval"`
+
+	// If greater than 1, the time between retries is multiplied by this
+	// after each attempt, up to RetryMaxInterval.
+	RetryBackoffMultiplier float64 `mapstructure:"retry_backoff_multiplier"`
+
+	// The HTTP statuses returned by WinRM that are retried. Any other
+	// status fails straight away. Defaults to 500, 502, 503 and 504.
+	RetryableStatusCodes []int `mapstructure:"retryable_status_codes"`
+
+	// The maximum time to wait between retries when backing off.
+	// Defaults to 1m.
+	RetryMaxInterval time.Duration `mapstructure:"retry_max_interval"`
+
+	// The maximum time DSC may run for before provisioning fails. Zero,
+	// the default, means there is no limit.
+	ExecuteTimeout time.Duration `mapstructure:"execute_timeout"`
+
+	// The maximum time the whole provisioning run, including uploads,
+	// LCM configuration and reboots, may take. Zero, the default, means
+	// there is no limit.
+	TotalTimeout time.Duration `mapstructure:"total_timeout"`
+
+	// The URL of a DSC pull server to register the node with.
+	//
+	// When set, the Local Configuration Manager is configured to pull
+	// its Configuration from the server, rather than a Configuration
+	// being applied by Packer.
+	PullServerURL string `mapstructure:"pull_server_url"`
+
+	// The registration key shared with the pull server.
+	RegistrationKey string `mapstructure:"registration_key"`
+
+	// The names of the Configurations to pull from the pull server.
+	ConfigurationNames []string `mapstructure:"configuration_names"`
+
 	// Specify remote DSC resources to be installed prior to the DSC execution
 	// InstallResources map[string]string  `mapstructure:"install_resources"`
 }
+
+// PartialConfiguration is a pre-generated MOF applied as one of the
+// partial configurations of the node
+type PartialConfiguration struct {
+	// The name of the partial configuration, which must match the
+	// Configuration the MOF was generated from.
+	Name string `mapstructure:"name"`
+
+	// Relative path to the pre-generated MOF file, or a folder
+	// containing it.
+	//
+	// Path is relative to the folder containing the Packer json.
+	MofPath string `mapstructure:"mof_path"`
+
+	// The names of the partial configurations that must be applied
+	// before this one. Each must be listed before it.
+	DependsOn []string `mapstructure:"depends_on"`
+}
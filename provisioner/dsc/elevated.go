@@ -0,0 +1,158 @@
+package dsc
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"text/template"
+	"unicode/utf16"
+
+	"github.com/hashicorp/packer/common/uuid"
+	"github.com/hashicorp/packer/packer"
+)
+
+type elevatedOptions struct {
+	User            string
+	Password        string
+	TaskName        string
+	TaskDescription string
+	EncodedCommand  string
+	ExecutionPolicy string
+	PowerShell      string
+}
+
+// The values in the task XML are XML escaped, and those passed to
+// RegisterTaskDefinition are single-quoted, so that they are used literally
+var elevatedTemplate = template.Must(template.New("ElevatedCommand").Funcs(template.FuncMap{
+	"escapeXML":          escapeXML,
+	"escapeSingleQuotes": singleQuoteEscaper.Replace,
+}).Parse(`
+# The wrapper holds the password, so it removes itself before anything else
+Remove-Item -LiteralPath $MyInvocation.MyCommand.Path -Force -ErrorAction SilentlyContinue
+$name = "{{.TaskName}}"
+$log = "$env:SystemRoot\Temp\$name.out"
+$s = New-Object -ComObject "Schedule.Service"
+$s.Connect()
+$t = $s.NewTask($null)
+$t.XmlText = @'
+<?xml version="1.0" encoding="UTF-16"?>
+<Task version="1.2" xmlns="http://schemas.microsoft.com/windows/2004/02/mit/task">
+  <RegistrationInfo>
+	<Description>{{escapeXML .TaskDescription}}</Description>
+  </RegistrationInfo>
+  <Principals>
+    <Principal id="Author">
+      <UserId>{{escapeXML .User}}</UserId>
+      <LogonType>Password</LogonType>
+      <RunLevel>HighestAvailable</RunLevel>
+    </Principal>
+  </Principals>
+  <Settings>
+    <MultipleInstancesPolicy>IgnoreNew</MultipleInstancesPolicy>
+    <DisallowStartIfOnBatteries>false</DisallowStartIfOnBatteries>
+    <StopIfGoingOnBatteries>false</StopIfGoingOnBatteries>
+    <AllowHardTerminate>true</AllowHardTerminate>
+    <StartWhenAvailable>false</StartWhenAvailable>
+    <RunOnlyIfNetworkAvailable>false</RunOnlyIfNetworkAvailable>
+    <IdleSettings>
+      <StopOnIdleEnd>false</StopOnIdleEnd>
+      <RestartOnIdle>false</RestartOnIdle>
+    </IdleSettings>
+    <AllowStartOnDemand>true</AllowStartOnDemand>
+    <Enabled>true</Enabled>
+    <Hidden>false</Hidden>
+    <RunOnlyIfIdle>false</RunOnlyIfIdle>
+    <WakeToRun>false</WakeToRun>
+    <ExecutionTimeLimit>PT24H</ExecutionTimeLimit>
+    <Priority>4</Priority>
+  </Settings>
+  <Actions Context="Author">
+    <Exec>
+      <Command>cmd</Command>
+	  <Arguments>/c {{escapeXML .PowerShell}} -ExecutionPolicy {{.ExecutionPolicy}} -EncodedCommand {{.EncodedCommand}} &gt; %SYSTEMROOT%\Temp\{{.TaskName}}.out 2&gt;&amp;1</Arguments>
+    </Exec>
+  </Actions>
+</Task>
+'@
+if (Test-Path variable:global:ProgressPreference){$ProgressPreference="SilentlyContinue"}
+$f = $s.GetFolder("\")
+$f.RegisterTaskDefinition($name, $t, 6, '{{escapeSingleQuotes .User}}', '{{escapeSingleQuotes .Password}}', 1, $null) | Out-Null
+$t = $f.GetTask("\$name")
+$t.Run($null) | Out-Null
+$timeout = 10
+$sec = 0
+while ((!($t.state -eq 4)) -and ($sec -lt $timeout)) {
+  Start-Sleep -s 1
+  $sec++
+}
+
+$line = 0
+do {
+  Start-Sleep -m 100
+  if (Test-Path $log) {
+    Get-Content $log | select -skip $line | ForEach {
+      $line += 1
+      Write-Output "$_"
+    }
+  }
+} while (!($t.state -eq 3))
+$result = $t.LastTaskResult
+if (Test-Path $log) {
+    Remove-Item $log -Force -ErrorAction SilentlyContinue | Out-Null
+}
+$f.DeleteTask($name, 0)
+[System.Runtime.Interopservices.Marshal]::ReleaseComObject($s) | Out-Null
+exit $result`))
+
+// powershellEncode encodes the command for use with -EncodedCommand,
+// which expects base64 encoded UTF-16LE.
+func powershellEncode(command string) string {
+	encoded := utf16.Encode([]rune(command))
+	buf := make([]byte, len(encoded)*2)
+	for i, c := range encoded {
+		binary.LittleEndian.PutUint16(buf[i*2:], c)
+	}
+
+	return base64.StdEncoding.EncodeToString(buf)
+}
+
+// escapeXML escapes s for use as text within the task XML
+func escapeXML(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
+
+// generateElevatedRunner uploads a wrapper which runs the given script
+// as a scheduled task under the elevated user, returning the command
+// used to run the wrapper.
+func (p *Provisioner) generateElevatedRunner(ctx context.Context, ui packer.Ui, comm packer.Communicator, remoteScriptPath string) (string, error) {
+	p.logf("debug", "Building elevated command wrapper for: %s", remoteScriptPath)
+
+	var buffer bytes.Buffer
+	err := elevatedTemplate.Execute(&buffer, elevatedOptions{
+		User:            p.config.ElevatedUser,
+		Password:        p.config.ElevatedPassword,
+		TaskDescription: "Packer DSC elevated task",
+		TaskName:        fmt.Sprintf("packer-dsc-%s", uuid.TimeOrderedUUID()),
+		EncodedCommand:  powershellEncode(fmt.Sprintf("& '%s'; exit $LastExitCode", singleQuoteEscaper.Replace(remoteScriptPath))),
+		ExecutionPolicy: p.config.ExecutionPolicy,
+		PowerShell:      p.powershellExecutable(),
+	})
+	if err != nil {
+		return "", fmt.Errorf("Error creating elevated template: %s", err)
+	}
+
+	path := fmt.Sprintf("%s/packer-dsc-elevated-%s.ps1", p.config.TempDir, uuid.TimeOrderedUUID())
+	if err := p.upload(ctx, ui, comm, path, buffer.Bytes()); err != nil {
+		return "", fmt.Errorf("Error uploading elevated wrapper: %s", err)
+	}
+	// The wrapper removes itself once run, but is cleaned up in case it
+	// never is, since it holds the password
+	p.addRemoteScript(path)
+
+	return fmt.Sprintf(`%s -ExecutionPolicy %s -File "%s"`, p.powershellExecutable(), p.config.ExecutionPolicy, path), nil
+}
@@ -0,0 +1,118 @@
+package dsc
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// lcmSettings contains the Local Configuration Manager settings that
+// may be configured, along with the values each of them accepts.
+//
+// Each key is the name of the property set in the Settings block of
+// the meta-configuration.
+var lcmSettings = map[string][]string{
+	"ActionAfterReboot":  {"ContinueConfiguration", "StopConfiguration"},
+	"ConfigurationMode":  {"ApplyOnly", "ApplyAndMonitor", "ApplyAndAutoCorrect"},
+	"RebootNodeIfNeeded": {"true", "false"},
+	"RefreshMode":        {"Push", "Pull", "Disabled"},
+}
+
+// LCMTemplate contains the template variables interpolated
+// into the Local Configuration Manager meta-configuration script
+type LCMTemplate struct {
+	OutputPath         string
+	Settings           []string
+	PullServerURL      string
+	RegistrationKey    string
+	ConfigurationNames string
+	AllowUnsecure      bool
+	Partials           []LCMPartial
+}
+
+// LCMPartial contains the template variables interpolated into the
+// meta-configuration for each partial configuration
+type LCMPartial struct {
+	Name      string
+	DependsOn string
+}
+
+// Template to generate and apply the LCM meta-configuration (meta-MOF)
+var lcmTemplate = `
+[DSCLocalConfigurationManager()]
+Configuration PackerLocalConfigurationManager
+{
+	Node localhost
+	{
+		Settings
+		{
+{{range .Settings}}			{{.}}
+{{end}}		}
+{{range .Partials}}
+		PartialConfiguration {{.Name}}
+		{
+			RefreshMode = "Push"{{if ne .DependsOn ""}}
+			DependsOn = @({{.DependsOn}}){{end}}
+		}
+{{end}}{{if ne .PullServerURL ""}}
+		ConfigurationRepositoryWeb PullServer
+		{
+			ServerURL = '{{.PullServerURL}}'
+			RegistrationKey = '{{.RegistrationKey}}'
+			ConfigurationNames = @({{.ConfigurationNames}})
+			AllowUnsecureConnection = ${{.AllowUnsecure}}
+		}
+
+		ResourceRepositoryWeb PullServer
+		{
+			ServerURL = '{{.PullServerURL}}'
+			RegistrationKey = '{{.RegistrationKey}}'
+			AllowUnsecureConnection = ${{.AllowUnsecure}}
+		}
+{{end}}	}
+}
+
+PackerLocalConfigurationManager -OutputPath "{{.OutputPath}}"
+Set-DscLocalConfigurationManager -Path "{{.OutputPath}}" -Verbose
+`
+
+// validateLCMSetting checks the given setting is supported, returning
+// the canonical form of the value.
+func validateLCMSetting(key string, value string) (string, error) {
+	allowed, ok := lcmSettings[key]
+	if !ok {
+		return "", fmt.Errorf("local_configuration_manager setting '%s' is not supported", key)
+	}
+
+	for _, v := range allowed {
+		if strings.EqualFold(v, value) {
+			return v, nil
+		}
+	}
+
+	return "", fmt.Errorf("local_configuration_manager setting '%s' must be one of: %s",
+		key, strings.Join(allowed, ", "))
+}
+
+// lcmSettingLines renders the LCM settings as PowerShell property
+// assignments, in a stable order.
+func lcmSettingLines(settings map[string]string) []string {
+	keys := make([]string, 0, len(settings))
+	for k := range settings {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	lines := make([]string, 0, len(keys))
+	for _, k := range keys {
+		v := settings[k]
+		switch v {
+		case "true", "false":
+			lines = append(lines, fmt.Sprintf("%s = $%s", k, v))
+		default:
+			lines = append(lines, fmt.Sprintf(`%s = "%s"`, k, v))
+		}
+	}
+
+	return lines
+}
@@ -0,0 +1,272 @@
+package dsc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/packer/packer"
+)
+
+// outputPrefix is prepended to each line of remote command output
+const outputPrefix = "dsc> "
+
+// stderrTailLines is the number of trailing lines of remote stderr
+// included in the error for a failed command.
+const stderrTailLines = 20
+
+// stderrTailBytes bounds the amount of stderr retained for each command.
+const stderrTailBytes = 8192
+
+// The levels accepted by log_level, from most to least verbose
+var logLevels = []string{"debug", "info", "warn"}
+
+// logf writes a message to the Packer log if level is at least
+// log_level, prefixed with [dsc] and the build name so that messages can
+// be told apart when several builds run at once. The values of
+// sensitive_vars are redacted.
+func (p *Provisioner) logf(level string, format string, v ...interface{}) {
+	if logLevelIndex(level) < logLevelIndex(p.config.LogLevel) {
+		return
+	}
+
+	prefix := "[dsc] "
+	if p.config.PackerBuildName != "" {
+		prefix = fmt.Sprintf("[dsc] [%s] ", p.config.PackerBuildName)
+	}
+	log.Print(prefix + p.redact(fmt.Sprintf(format, v...)))
+}
+
+// redact replaces the values of the environment_vars and
+// configuration_params named in sensitive_vars in s with ****, both as
+// given and as quoted for PowerShell.
+func (p *Provisioner) redact(s string) string {
+	if len(p.config.SensitiveVars) == 0 {
+		return s
+	}
+
+	sensitive := make(map[string]bool)
+	for _, name := range p.config.SensitiveVars {
+		sensitive[strings.TrimPrefix(name, "-")] = true
+	}
+
+	var values []string
+	for _, kv := range p.config.Vars {
+		if parts := strings.SplitN(kv, "=", 2); len(parts) == 2 && sensitive[parts[0]] {
+			values = append(values, parts[1])
+		}
+	}
+	for k, v := range p.config.ConfigurationParams {
+		if sensitive[strings.TrimPrefix(k, "-")] {
+			values = append(values, v)
+		}
+	}
+
+	// Longer values first, so that a value containing another is
+	// redacted whole
+	sort.Slice(values, func(i, j int) bool { return len(values[i]) > len(values[j]) })
+	for _, v := range values {
+		if v == "" {
+			continue
+		}
+		s = strings.Replace(s, singleQuoteEscaper.Replace(v), "****", -1)
+		s = strings.Replace(s, v, "****", -1)
+	}
+	return s
+}
+
+// logLevelIndex returns the position of level in logLevels, or -1 if it
+// isn't one
+func logLevelIndex(level string) int {
+	for i, l := range logLevels {
+		if l == level {
+			return i
+		}
+	}
+	return -1
+}
+
+// uiWriter is an io.Writer that sends each complete line written to
+// it to the Ui, prefixed so that output from the remote machine is
+// distinguishable from that of other provisioners.
+type uiWriter struct {
+	ui     packer.Ui
+	prefix string
+
+	buf  bytes.Buffer
+	lock sync.Mutex
+}
+
+func (w *uiWriter) Write(p []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.buf.Write(p)
+	for {
+		idx := bytes.IndexByte(w.buf.Bytes(), '\n')
+		if idx < 0 {
+			break
+		}
+
+		line := w.buf.Next(idx + 1)
+		w.message(string(line))
+	}
+
+	return len(p), nil
+}
+
+// Flush sends any remaining partial line to the Ui
+func (w *uiWriter) Flush() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.buf.Len() > 0 {
+		w.message(w.buf.String())
+		w.buf.Reset()
+	}
+}
+
+func (w *uiWriter) message(line string) {
+	// Trim up to the last carriage return, since that text would be
+	// lost anyways.
+	line = strings.TrimRight(line, "\r\n")
+	if idx := strings.LastIndex(line, "\r"); idx > -1 {
+		line = line[idx+1:]
+	}
+
+	w.ui.Message(w.prefix + line)
+}
+
+// tailWriter is an io.Writer that passes writes through to w, retaining
+// the most recent output so that it can be reported if the command fails.
+type tailWriter struct {
+	w io.Writer
+
+	buf  []byte
+	lock sync.Mutex
+}
+
+func (w *tailWriter) Write(p []byte) (int, error) {
+	w.lock.Lock()
+	w.buf = append(w.buf, p...)
+	if len(w.buf) > stderrTailBytes {
+		w.buf = w.buf[len(w.buf)-stderrTailBytes:]
+	}
+	w.lock.Unlock()
+
+	return w.w.Write(p)
+}
+
+// Tail returns the last stderrTailLines lines written
+func (w *tailWriter) Tail() string {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	output := strings.TrimRight(string(w.buf), "\r\n")
+	if output == "" {
+		return ""
+	}
+
+	lines := strings.Split(output, "\n")
+	if len(lines) > stderrTailLines {
+		lines = lines[len(lines)-stderrTailLines:]
+	}
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, "\r")
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// syncWriter is an io.Writer that serialises writes to w, so that a
+// command's stdout and stderr, which communicators copy concurrently, can
+// share it.
+type syncWriter struct {
+	w    io.Writer
+	lock sync.Mutex
+}
+
+func (w *syncWriter) Write(p []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	return w.w.Write(p)
+}
+
+// exitError returns the error for a command that exited with a non-zero
+// exit status, including the tail of its stderr when it was run with
+// runCommand.
+func exitError(name string, cmd *packer.RemoteCmd) error {
+	msg := fmt.Sprintf("%s exited with a non-zero exit status: %d", name, cmd.ExitStatus)
+	if w, ok := cmd.Stderr.(*tailWriter); ok {
+		if tail := w.Tail(); tail != "" {
+			msg = fmt.Sprintf("%s\n\nLast lines of stderr:\n%s", msg, tail)
+		}
+	}
+
+	return errors.New(msg)
+}
+
+// runCommand runs the remote command, streaming its output line by line
+// to the Ui, and waits for it to complete or for ctx to be done.
+//
+// If show_progress is disabled, output is only sent to the Ui once the
+// command has completed, and only if it failed. The tail of stderr is
+// retained in either case for use by exitError.
+func (p *Provisioner) runCommand(ctx context.Context, ui packer.Ui, comm packer.Communicator, cmd *packer.RemoteCmd) error {
+	stdout := &uiWriter{ui: ui, prefix: outputPrefix}
+	stderr := &uiWriter{ui: ui, prefix: outputPrefix}
+
+	var output bytes.Buffer
+	if p.config.ShowProgress {
+		cmd.Stdout = stdout
+		cmd.Stderr = &tailWriter{w: stderr}
+	} else {
+		w := &syncWriter{w: &output}
+		cmd.Stdout = w
+		cmd.Stderr = &tailWriter{w: w}
+	}
+
+	p.logf("debug", "Running remote command: %s", cmd.Command)
+	if err := comm.Start(cmd); err != nil {
+		return p.communicatorError(fmt.Errorf("Error starting remote command '%s': %s", cmd.Command, err))
+	}
+
+	if err := waitCommand(ctx, cmd); err != nil {
+		stdout.Flush()
+		stderr.Flush()
+		return err
+	}
+
+	if !p.config.ShowProgress && cmd.ExitStatus != 0 {
+		stdout.Write(output.Bytes())
+	}
+
+	stdout.Flush()
+	stderr.Flush()
+
+	return nil
+}
+
+// waitCommand waits for the started command to complete, returning the
+// error from ctx if it is done first.
+func waitCommand(ctx context.Context, cmd *packer.RemoteCmd) error {
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+
+	select {
+	case <-exited:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
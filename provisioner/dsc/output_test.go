@@ -0,0 +1,214 @@
+package dsc
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/hashicorp/packer/packer"
+)
+
+func TestUiWriter(t *testing.T) {
+	var out bytes.Buffer
+	ui := &packer.BasicUi{
+		Reader: new(bytes.Buffer),
+		Writer: &out,
+	}
+
+	w := &uiWriter{ui: ui, prefix: outputPrefix}
+	w.Write([]byte("foo\r\nba"))
+	w.Write([]byte("r\n"))
+	w.Write([]byte("progress 50%\rprogress 100%\nbaz"))
+
+	expected := "dsc> foo\ndsc> bar\ndsc> progress 100%\n"
+	if out.String() != expected {
+		t.Fatalf("Expected:\n\n%s\n\nbut got: \n\n%s", expected, out.String())
+	}
+
+	w.Flush()
+	expected += "dsc> baz\n"
+	if out.String() != expected {
+		t.Fatalf("Expected:\n\n%s\n\nbut got: \n\n%s", expected, out.String())
+	}
+}
+
+func TestProvisioner_runCommand(t *testing.T) {
+	var out bytes.Buffer
+	ui := &packer.BasicUi{
+		Reader: new(bytes.Buffer),
+		Writer: &out,
+	}
+	comm := new(packer.MockCommunicator)
+	comm.StartStdout = "Configuration applied\nno trailing newline"
+	comm.StartExitStatus = 3
+
+	p := new(Provisioner)
+	p.config.ShowProgress = true
+	cmd := &packer.RemoteCmd{Command: "Start-DscConfiguration"}
+	if err := p.runCommand(context.Background(), ui, comm, cmd); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if cmd.ExitStatus != 3 {
+		t.Fatalf("Expected exit status 3 but got %d", cmd.ExitStatus)
+	}
+
+	expected := "dsc> Configuration applied\ndsc> no trailing newline\n"
+	if out.String() != expected {
+		t.Fatalf("Expected:\n\n%s\n\nbut got: \n\n%s", expected, out.String())
+	}
+}
+
+func TestProvisioner_runCommandNoProgress(t *testing.T) {
+	var out bytes.Buffer
+	ui := &packer.BasicUi{
+		Reader: new(bytes.Buffer),
+		Writer: &out,
+	}
+	comm := new(packer.MockCommunicator)
+	comm.StartStdout = "Configuration applied\n"
+
+	p := new(Provisioner)
+	p.config.ShowProgress = false
+	cmd := &packer.RemoteCmd{Command: "Start-DscConfiguration"}
+	if err := p.runCommand(context.Background(), ui, comm, cmd); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if out.Len() != 0 {
+		t.Fatalf("Expected no output but got: %s", out.String())
+	}
+
+	// Output is shown if the command fails
+	comm.StartExitStatus = 1
+	cmd = &packer.RemoteCmd{Command: "Start-DscConfiguration"}
+	if err := p.runCommand(context.Background(), ui, comm, cmd); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if out.String() != "dsc> Configuration applied\n" {
+		t.Fatalf("Expected failed command output but got: %s", out.String())
+	}
+}
+
+// concurrentCommunicator writes to stdout and stderr at once, as the
+// WinRM communicator does.
+type concurrentCommunicator struct {
+	packer.MockCommunicator
+	Lines int
+}
+
+func (c *concurrentCommunicator) Start(rc *packer.RemoteCmd) error {
+	go func() {
+		var wg sync.WaitGroup
+		for _, w := range []io.Writer{rc.Stdout, rc.Stderr} {
+			wg.Add(1)
+			go func(w io.Writer) {
+				defer wg.Done()
+				for i := 0; i < c.Lines; i++ {
+					w.Write([]byte("output line\n"))
+				}
+			}(w)
+		}
+		wg.Wait()
+		rc.SetExited(1)
+	}()
+	return nil
+}
+
+func TestProvisioner_runCommandNoProgressConcurrent(t *testing.T) {
+	var out bytes.Buffer
+	ui := &packer.BasicUi{
+		Reader: new(bytes.Buffer),
+		Writer: &out,
+	}
+	comm := &concurrentCommunicator{Lines: 1000}
+
+	p := new(Provisioner)
+	p.config.ShowProgress = false
+	cmd := &packer.RemoteCmd{Command: "Start-DscConfiguration"}
+	if err := p.runCommand(context.Background(), ui, comm, cmd); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected := strings.Repeat("dsc> output line\n", 2*comm.Lines)
+	if out.String() != expected {
+		t.Fatalf("Expected %d lines of output but got: %s", 2*comm.Lines, out.String())
+	}
+}
+
+func TestProvisioner_exitErrorStderrTail(t *testing.T) {
+	ui := &packer.BasicUi{
+		Reader: new(bytes.Buffer),
+		Writer: new(bytes.Buffer),
+	}
+
+	var stderr []string
+	for i := 1; i <= 30; i++ {
+		stderr = append(stderr, fmt.Sprintf("error line %d\r", i))
+	}
+	comm := new(packer.MockCommunicator)
+	comm.StartStderr = strings.Join(stderr, "\n") + "\n"
+	comm.StartExitStatus = 1
+
+	p := new(Provisioner)
+	p.config.ShowProgress = true
+	cmd := &packer.RemoteCmd{Command: "Start-DscConfiguration"}
+	if err := p.runCommand(context.Background(), ui, comm, cmd); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	err := exitError("DSC", cmd).Error()
+	if !strings.HasPrefix(err, "DSC exited with a non-zero exit status: 1\n\nLast lines of stderr:\nerror line 11\n") {
+		t.Fatalf("Expected error to include the stderr tail but got: %s", err)
+	}
+	if !strings.HasSuffix(err, "\nerror line 30") {
+		t.Fatalf("Expected error to end with the last stderr line but got: %s", err)
+	}
+	if strings.Contains(err, "error line 10\n") {
+		t.Fatalf("Expected only the last %d lines of stderr but got: %s", stderrTailLines, err)
+	}
+
+	// No stderr means no tail
+	comm.StartStderr = ""
+	cmd = &packer.RemoteCmd{Command: "Start-DscConfiguration"}
+	if err := p.runCommand(context.Background(), ui, comm, cmd); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := exitError("DSC", cmd).Error(); err != "DSC exited with a non-zero exit status: 1" {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+}
+
+func TestProvisionerLogf(t *testing.T) {
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+
+	p := new(Provisioner)
+	p.config.LogLevel = "info"
+	p.config.PackerBuildName = "web"
+
+	p.logf("debug", "Retryable error: %s", "timeout")
+	if out.Len() != 0 {
+		t.Fatalf("Expected debug messages to be hidden but got: %s", out.String())
+	}
+
+	p.logf("warn", "DSC run interrupted")
+	if !strings.Contains(out.String(), "[dsc] [web] DSC run interrupted") {
+		t.Fatalf("Expected a prefixed message but got: %s", out.String())
+	}
+
+	config := testConfig()
+	config["log_level"] = "trace"
+	p = new(Provisioner)
+	if err := p.Prepare(config); err == nil {
+		t.Fatal("should have error")
+	}
+}
@@ -0,0 +1,65 @@
+package dsc
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hashicorp/go-version"
+	"github.com/hashicorp/packer/packer"
+)
+
+// Outputs the version of PowerShell on the remote host
+var powershellVersionScript = `$PSVersionTable.PSVersion.ToString()`
+
+// Outputs Missing if the DSC module isn't installed on the remote host
+var dscModuleScript = `if (-not (Get-Module -ListAvailable PSDesiredStateConfiguration)) { 'Missing' }`
+
+// checkPowerShellVersion fails if the version of PowerShell on the remote
+// host is below min_powershell_version. DSC behaves quite differently
+// between WMF 4.0 and 5.0, so it's better to fail early than with an
+// obscure error part way through a Configuration.
+func (p *Provisioner) checkPowerShellVersion(ctx context.Context, ui packer.Ui, comm packer.Communicator) error {
+	ui.Message("Checking the PowerShell version...")
+
+	output, err := p.remoteOutput(ctx, comm, p.powershellCommand(powershellVersionScript))
+	if err != nil {
+		return err
+	}
+
+	current, err := version.NewVersion(output)
+	if err != nil {
+		return fmt.Errorf("Unable to parse PowerShell version '%s': %s", output, err)
+	}
+
+	minimum, err := version.NewVersion(p.config.MinPowerShellVersion)
+	if err != nil {
+		return err
+	}
+
+	if current.LessThan(minimum) {
+		return fmt.Errorf("PowerShell %s is installed, but min_powershell_version requires %s or later", current, minimum)
+	}
+
+	return nil
+}
+
+// checkDscModule fails if the PSDesiredStateConfiguration module isn't
+// available on the remote host, as on Nano Server or with PowerShell 6
+// and later, rather than leaving Start-DscConfiguration to fail.
+func (p *Provisioner) checkDscModule(ctx context.Context, ui packer.Ui, comm packer.Communicator) error {
+	ui.Message("Checking DSC is available...")
+
+	output, err := p.remoteOutput(ctx, comm, p.powershellCommand(dscModuleScript))
+	if err != nil {
+		return err
+	}
+
+	if output == "Missing" {
+		return fmt.Errorf("The PSDesiredStateConfiguration module is not available. " +
+			"Install Windows Management Framework 5.1 or later, or for PowerShell 7 " +
+			"install it with 'Install-Module PSDesiredStateConfiguration'. " +
+			"Set skip_preflight to skip this check.")
+	}
+
+	return nil
+}
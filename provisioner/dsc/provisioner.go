@@ -6,12 +6,22 @@
 package dsc
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/hashicorp/go-version"
+	"github.com/hashicorp/packer/common/uuid"
 	"github.com/hashicorp/packer/helper/config"
 	"github.com/hashicorp/packer/packer"
 	"github.com/hashicorp/packer/template/interpolate"
@@ -20,6 +30,25 @@ import (
 // Provisioner DSC
 type Provisioner struct {
 	config Config
+
+	// Scripts uploaded outside of the staging directory, removed
+	// along with it by cleanup
+	remoteScripts []string
+
+	// The files and directories created within the staging directory,
+	// removed by cleanup_remote_path
+	remotePaths []string
+
+	// The outcome of the current Provision, written to output_json
+	summary provisionSummary
+
+	// Set while the DSC runner is running, so that a run abandoned on a
+	// timeout is known to still be running on the remote host
+	dscRunning bool
+
+	// Cancels the context of a running Provision
+	cancel     context.CancelFunc
+	cancelLock sync.Mutex
 }
 
 // ExecuteTemplate contains the template variables interpolated
@@ -32,19 +61,74 @@ type ExecuteTemplate struct {
 	ModulePath            string
 	ManifestFile          string
 	ManifestDir           string
+	ScriptDir             string
+	OutputDir             string
+	MofOutputPath         string
 	MofPath               string
+	PartialPaths          string
+	WhatIf                bool
+	Verbose               bool
+	PowerShell            string
+}
+
+var powershellTemplate = `%s -ExecutionPolicy %s -Command "& { %s; exit $LastExitCode}"`
+
+// The execution policies accepted by execution_policy
+var executionPolicies = []string{
+	"AllSigned", "Bypass", "Default", "RemoteSigned", "Restricted", "Undefined", "Unrestricted",
 }
 
-var powershellTemplate = `powershell "& { %s; exit $LastExitCode}"`
+var retryableSleep = 2 * time.Second
+
+// Parameter names accepted by configuration_params, with or without a
+// leading dash
+var configurationParamRegexp = regexp.MustCompile(`^-?[A-Za-z][A-Za-z0-9_]*$`)
+
+// Names accepted for partial_configurations, which must be valid
+// Configuration names
+var partialNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Absolute remote paths, with or without a drive letter
+var absolutePathRegexp = regexp.MustCompile(`^([A-Za-z]:)?[\\/]`)
+
+// Module names and versions accepted by install_modules
+var moduleNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+var moduleVersionRegexp = regexp.MustCompile(`^[0-9]+(\.[0-9]+){0,3}$`)
+
+// Shows debug messages from DSC resources when debug is enabled
+var debugPreference = "$DebugPreference = 'Continue'\n"
+
+// envVarFormat is used to set each environment variable in the DSC runner
+var envVarFormat = "$env:%s = '%s'\n"
+
+// Environment variable names which can be set with envVarFormat
+var envVarNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Removes a Configuration left pending by an earlier run
+var clearPendingScript = "Remove-DscConfigurationDocument -Stage Pending -Force"
+
+// Stops a DSC run abandoned on a timeout
+var stopDscScript = "Stop-DscConfiguration -Force"
+
+// Escapes a value for use within a single-quoted PowerShell string
+var singleQuoteEscaper = strings.NewReplacer("'", "''", "\u2018", "\u2018\u2018", "\u2019", "\u2019\u2019")
 
 // Prepare sets up the DSC configuration
 func (p *Provisioner) Prepare(raws ...interface{}) error {
+	// Defaults for booleans which are enabled unless configured otherwise
+	p.config.CleanupRemotePath = true
+	p.config.ShowProgress = true
+	p.config.ReportStatus = true
+	p.config.Verbose = true
+	p.config.VerifyUpload = true
+
 	err := config.Decode(&p.config, &config.DecodeOpts{
 		Interpolate:        true,
 		InterpolateContext: &p.config.ctx,
 		InterpolateFilter: &interpolate.RenderFilter{
 			Exclude: []string{
 				"execute_command",
+				"powershell_executable",
 			},
 		},
 	}, raws...)
@@ -62,6 +146,9 @@ func (p *Provisioner) Prepare(raws ...interface{}) error {
 # and runs the DSC Configuration.
 #
 #
+# Run from the working directory, so relative paths resolve against it
+cd "{{.WorkingDir}}"
+
 # Set the local PowerShell Module environment path
 {{if ne .ModulePath ""}}
 $absoluteModulePaths = [string]::Join(";", ("{{.ModulePath}}".Split(";") | ForEach-Object { $_ | Resolve-Path }))
@@ -70,17 +157,24 @@ $env:PSModulePath="$absoluteModulePaths;${env:PSModulePath}"
 ("{{.ModulePath}}".Split(";") | ForEach-Object { gci -Recurse  $_ | ForEach-Object { Unblock-File  $_.FullName} })
 {{end}}
 
-$script = $("{{.ManifestFile}}" | Resolve-Path)
 echo "PSModulePath Configured: ${env:PSModulePath}"
-echo "Running Configuration file: ${script}"
 
-{{if eq .MofPath ""}}
+{{if ne .PartialPaths ""}}
+# Publish each partial configuration, in order, then apply them together
+("{{.PartialPaths}}".Split(";") | ForEach-Object { Publish-DscConfiguration -Force{{if .Verbose}} -Verbose{{end}} -Path $_ })
+
+# Start a DSC Configuration run
+Start-DscConfiguration -Force -Wait{{if .Verbose}} -Verbose{{end}} -UseExisting
+{{else}}{{if eq .MofPath ""}}
 # Generate the MOF file, only if a MOF path not already provided.
-# Import the Manifest
+{{if ne .ScriptDir ""}}# Dot-source the supporting scripts
+foreach ($s in (Get-ChildItem -Recurse -Filter *.ps1 "{{.ScriptDir}}" | Sort-Object FullName)) { . $s.FullName }
+{{end}}# Import the Manifest
+$script = $("{{.ManifestFile}}" | Resolve-Path)
+echo "Running Configuration file: ${script}"
 . $script
 
-cd "{{.WorkingDir}}"
-$StagingPath = $(Join-Path "{{.WorkingDir}}" "staging")
+{{if ne .MofOutputPath ""}}$StagingPath = "{{.MofOutputPath}}"{{else}}$StagingPath = $(Join-Path "{{.WorkingDir}}" "{{.OutputDir}}"){{end}}
 {{if ne .ConfigurationFilePath ""}}
 $Config = $(iex (Get-Content ("{{.ConfigurationFilePath}}" | Resolve-Path) | Out-String))
 {{end}}
@@ -90,23 +184,74 @@ $StagingPath = "{{.MofPath}}"
 {{end}}
 
 # Start a DSC Configuration run
-Start-DscConfiguration -Force -Wait -Verbose -Path $StagingPath`
+Start-DscConfiguration -Force -Wait{{if .Verbose}} -Verbose{{end}} -Path $StagingPath{{if .WhatIf}} -WhatIf{{end}}{{end}}`
 	}
 
+	if p.config.TempDir == "" {
+		p.config.TempDir = "/tmp"
+	}
+	p.config.TempDir = strings.TrimRight(p.config.TempDir, `/\`)
+
 	if p.config.StagingDir == "" {
-		p.config.StagingDir = "/tmp/packer-dsc-pull"
+		p.config.StagingDir = p.config.TempDir + "/packer-dsc-pull"
 	}
 
 	if p.config.WorkingDir == "" {
 		p.config.WorkingDir = p.config.StagingDir
 	}
 
+	if p.config.ExecutionPolicy == "" {
+		p.config.ExecutionPolicy = "Bypass"
+	}
+
+	if p.config.PowerShellExecutable == "" {
+		p.config.PowerShellExecutable = "powershell"
+	}
+
+	if p.config.LogLevel == "" {
+		p.config.LogLevel = "info"
+	}
+
+	if p.config.StatusOutputFormat == "" {
+		p.config.StatusOutputFormat = "text"
+	}
+
+	if p.config.StartRetryTimeout == 0 {
+		p.config.StartRetryTimeout = 5 * time.Minute
+	}
+
+	if p.config.RetryInterval == 0 {
+		p.config.RetryInterval = retryableSleep
+	}
+
+	if p.config.RetryableStatusCodes == nil {
+		p.config.RetryableStatusCodes = defaultRetryableStatusCodes
+	}
+
+	if p.config.RetryMaxInterval == 0 {
+		p.config.RetryMaxInterval = time.Minute
+	}
+
+	if p.config.Vars == nil {
+		p.config.Vars = make([]string, 0)
+	}
+
 	if p.config.ConfigurationParams == nil {
 		p.config.ConfigurationParams = make(map[string]string)
 	}
 
 	// Validation
 	var errs *packer.MultiError
+
+	// Catch mistakes in a custom execute_command now, rather than once
+	// everything has been uploaded
+	ctx := p.config.ctx
+	ctx.Data = &ExecuteTemplate{}
+	if _, err := interpolate.Render(p.config.ExecuteCommand, &ctx); err != nil {
+		errs = packer.MultiErrorAppend(errs,
+			fmt.Errorf("execute_command is invalid: %s", err))
+	}
+
 	if p.config.ConfigurationFilePath != "" {
 		info, err := os.Stat(p.config.ConfigurationFilePath)
 		if err != nil {
@@ -118,6 +263,38 @@ Start-DscConfiguration -Force -Wait -Verbose -Path $StagingPath`
 		}
 	}
 
+	if p.config.OutputMofDirectory != "" {
+		info, err := os.Stat(p.config.OutputMofDirectory)
+		if os.IsNotExist(err) {
+			err = os.MkdirAll(p.config.OutputMofDirectory, 0755)
+		}
+		if err != nil {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("output_mof_directory is invalid: %s", err))
+		} else if info != nil && !info.IsDir() {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("output_mof_directory must point to a directory"))
+		}
+	}
+
+	if p.config.PreApplyScript != "" {
+		if _, err := os.Stat(p.config.PreApplyScript); err != nil {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("pre_apply_script is invalid: %s", err))
+		}
+	}
+
+	if p.config.ScriptDir != "" {
+		info, err := os.Stat(p.config.ScriptDir)
+		if err != nil {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("script_dir is invalid: %s", err))
+		} else if !info.IsDir() {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("script_dir must point to a directory"))
+		}
+	}
+
 	if p.config.ManifestDir != "" {
 		info, err := os.Stat(p.config.ManifestDir)
 		if err != nil {
@@ -129,19 +306,140 @@ Start-DscConfiguration -Force -Wait -Verbose -Path $StagingPath`
 		}
 	}
 
-	if p.config.ManifestFile == "" {
-		errs = packer.MultiErrorAppend(errs,
-			fmt.Errorf("A manifest_file must be specified."))
-	} else {
-		_, err := os.Stat(p.config.ManifestFile)
+	if err := p.checkSources(); err != nil {
+		errs = packer.MultiErrorAppend(errs, err)
+	}
+
+	if p.config.PullServerURL != "" {
+		// The Configuration is pulled by the LCM rather than applied by Packer
+		u, err := url.Parse(p.config.PullServerURL)
+		if err != nil {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("pull_server_url is invalid: %s", err))
+		} else if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("pull_server_url must be an http or https URL"))
+		}
+
+		if p.config.WhatIf {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("what_if cannot be used with pull_server_url"))
+		}
+
+		if p.config.FailIfNoChanges {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("fail_if_no_changes cannot be used with pull_server_url"))
+		}
+
+		if p.config.RegistrationKey == "" {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("A registration_key must be specified with pull_server_url."))
+		}
+
+		if mode, ok := p.config.LocalConfigurationManager["RefreshMode"]; ok && !strings.EqualFold(mode, "Pull") {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("local_configuration_manager RefreshMode must be Pull when pull_server_url is specified"))
+		}
+	}
+
+	if p.config.MofPath != "" {
+		// A pre-generated MOF is applied as-is, without compiling a Configuration
+		info, err := os.Stat(p.config.MofPath)
+		if err != nil {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("mof_path is invalid: %s", err))
+		} else if !info.IsDir() && !isMofFile(p.config.MofPath) {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("mof_path must point to a .mof file or a directory"))
+		}
+	}
+
+	// Partial configurations are published in order, so each may only
+	// depend on those listed before it
+	partials := make(map[string]bool)
+	for i, partial := range p.config.PartialConfigurations {
+		if !partialNameRegexp.MatchString(partial.Name) {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("partial_configurations[%d] name is invalid: '%s'", i, partial.Name))
+		} else if partials[partial.Name] {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("partial_configurations[%d] name '%s' is already used", i, partial.Name))
+		}
+
+		info, err := os.Stat(partial.MofPath)
 		if err != nil {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("partial_configurations[%d] mof_path is invalid: %s", i, err))
+		} else if !info.IsDir() && !isMofFile(partial.MofPath) {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("partial_configurations[%d] mof_path must point to a .mof file or a directory", i))
+		}
+
+		for _, name := range partial.DependsOn {
+			if !partials[name] {
+				errs = packer.MultiErrorAppend(errs,
+					fmt.Errorf("partial_configurations[%d] depends on '%s', which must be listed before it", i, name))
+			}
+		}
+		partials[partial.Name] = true
+	}
+
+	if len(p.config.PartialConfigurations) > 0 {
+		// Publishing leaves the partials pending, so they can't be previewed
+		if p.config.WhatIf {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("what_if cannot be used with partial_configurations"))
+		}
+
+		if mode, ok := p.config.LocalConfigurationManager["RefreshMode"]; ok && !strings.EqualFold(mode, "Push") {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("local_configuration_manager RefreshMode must be Push when partial_configurations are specified"))
+		}
+	}
+
+	if p.config.ManifestFile != "" {
+		if _, err := os.Stat(p.config.ManifestFile); err != nil {
 			errs = packer.MultiErrorAppend(errs,
 				fmt.Errorf("manifest_file is invalid: %s", err))
 		}
 	}
 
-	if p.config.ConfigurationName == "" {
-		p.config.ConfigurationName = strings.Split(filepath.Base(p.config.ManifestFile), ".")[0]
+	// Each of manifest_files is compiled into a directory named after
+	// its Configuration, so the names must be unique
+	names := make(map[string]bool)
+	for i, manifest := range p.config.ManifestFiles {
+		if _, err := os.Stat(manifest); err != nil {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("manifest_files[%d] is invalid: %s", i, err))
+		}
+
+		name := configurationName(manifest)
+		if names[name] {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("manifest_files[%d] has the same Configuration name as an earlier file: %s", i, name))
+		}
+		names[name] = true
+	}
+
+	if len(p.config.ManifestFiles) > 0 {
+		if p.config.ConfigurationName != "" {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("configuration_name cannot be used with manifest_files, as each Configuration is named after its file"))
+		}
+
+		if p.config.OutputMofDirectory != "" {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("output_mof_directory cannot be used with manifest_files"))
+		}
+	}
+
+	if p.config.ConfigurationName == "" && p.config.ManifestFile != "" {
+		p.config.ConfigurationName = configurationName(p.config.ManifestFile)
+	}
+
+	if p.config.InlineManifest != "" && p.config.ConfigurationName == "" {
+		errs = packer.MultiErrorAppend(errs,
+			fmt.Errorf("A configuration_name must be specified with inline_manifest."))
 	}
 
 	for i, path := range p.config.ModulePaths {
@@ -166,6 +464,156 @@ Start-DscConfiguration -Force -Wait -Verbose -Path $StagingPath`
 		}
 	}
 
+	if p.config.FailIfNoChanges && p.config.WhatIf {
+		errs = packer.MultiErrorAppend(errs,
+			fmt.Errorf("fail_if_no_changes cannot be used with what_if"))
+	}
+
+	if !absolutePathRegexp.MatchString(p.config.TempDir) {
+		errs = packer.MultiErrorAppend(errs,
+			fmt.Errorf("temp_dir must be an absolute path"))
+	}
+
+	if p.config.ExecuteTimeout < 0 {
+		errs = packer.MultiErrorAppend(errs,
+			fmt.Errorf("execute_timeout must not be negative"))
+	}
+
+	if p.config.TotalTimeout < 0 {
+		errs = packer.MultiErrorAppend(errs,
+			fmt.Errorf("total_timeout must not be negative"))
+	}
+
+	if p.config.MaxRetries < 0 {
+		errs = packer.MultiErrorAppend(errs,
+			fmt.Errorf("max_retries must not be negative"))
+	}
+
+	if p.config.RetryInterval < 0 {
+		errs = packer.MultiErrorAppend(errs,
+			fmt.Errorf("retry_interval must not be negative"))
+	}
+
+	if p.config.RetryMaxInterval < 0 {
+		errs = packer.MultiErrorAppend(errs,
+			fmt.Errorf("retry_max_interval must not be negative"))
+	}
+
+	for i, code := range p.config.RetryableStatusCodes {
+		if code == 401 {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("retryable_status_codes[%d] must not be 401, as the credentials were rejected", i))
+		} else if code < 400 || code > 599 {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("retryable_status_codes[%d] must be an HTTP error status from 400 to 599", i))
+		}
+	}
+
+	if p.config.RetryBackoffMultiplier != 0 && p.config.RetryBackoffMultiplier < 1 {
+		errs = packer.MultiErrorAppend(errs,
+			fmt.Errorf("retry_backoff_multiplier must be 1 or more"))
+	}
+
+	if p.config.MinPowerShellVersion != "" {
+		if _, err := version.NewVersion(p.config.MinPowerShellVersion); err != nil {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("min_powershell_version is invalid: %s", err))
+		}
+	}
+
+	if strings.Contains(p.config.PowerShellExecutable, `"`) {
+		errs = packer.MultiErrorAppend(errs,
+			fmt.Errorf("powershell_executable must not contain quotes"))
+	}
+
+	validPolicy := false
+	for _, policy := range executionPolicies {
+		if strings.EqualFold(policy, p.config.ExecutionPolicy) {
+			p.config.ExecutionPolicy = policy
+			validPolicy = true
+		}
+	}
+	if !validPolicy {
+		errs = packer.MultiErrorAppend(errs,
+			fmt.Errorf("execution_policy must be one of: %s", strings.Join(executionPolicies, ", ")))
+	}
+
+	if logLevelIndex(p.config.LogLevel) == -1 {
+		errs = packer.MultiErrorAppend(errs,
+			fmt.Errorf("log_level must be one of: %s", strings.Join(logLevels, ", ")))
+	}
+
+	if p.config.StatusOutputFormat != "text" && p.config.StatusOutputFormat != "json" {
+		errs = packer.MultiErrorAppend(errs,
+			fmt.Errorf("status_output_format must be one of: text, json"))
+	}
+
+	if len(p.config.ValidExitCodes) == 0 {
+		p.config.ValidExitCodes = defaultValidExitCodes
+	} else if p.config.IgnoreExitCodes {
+		errs = packer.MultiErrorAppend(errs,
+			fmt.Errorf("valid_exit_codes cannot be used with ignore_exit_codes"))
+	}
+
+	if p.config.ElevatedUser != "" && p.config.ElevatedPassword == "" {
+		errs = packer.MultiErrorAppend(errs,
+			fmt.Errorf("Must supply an 'elevated_password' if 'elevated_user' provided"))
+	}
+
+	if p.config.ElevatedUser == "" && p.config.ElevatedPassword != "" {
+		errs = packer.MultiErrorAppend(errs,
+			fmt.Errorf("Must supply an 'elevated_user' if 'elevated_password' provided"))
+	}
+
+	// Variables from the file come first, so environment_vars take precedence
+	if p.config.VarsFile != "" {
+		vars, err := readVarsFile(p.config.VarsFile)
+		if err != nil {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("environment_vars_file is invalid: %s", err))
+		}
+		p.config.Vars = append(vars, p.config.Vars...)
+	}
+
+	// Do a check for bad environment variables, such as '=foo', 'foobar'
+	for _, kv := range p.config.Vars {
+		vs := strings.SplitN(kv, "=", 2)
+		if len(vs) != 2 || vs[0] == "" {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("Environment variable not in format 'key=value': %s", kv))
+		} else if !envVarNameRegexp.MatchString(vs[0]) {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("Environment variable name is invalid: '%s'", vs[0]))
+		}
+	}
+
+	for k := range p.config.ConfigurationParams {
+		if !configurationParamRegexp.MatchString(k) {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("configuration_params name is invalid: '%s'", k))
+		}
+	}
+
+	for name, version := range p.config.InstallModules {
+		if !moduleNameRegexp.MatchString(name) {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("install_modules name is invalid: '%s'", name))
+		}
+		if version != "" && !moduleVersionRegexp.MatchString(version) {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("install_modules version for '%s' is invalid: '%s'", name, version))
+		}
+	}
+
+	for k, v := range p.config.LocalConfigurationManager {
+		value, err := validateLCMSetting(k, v)
+		if err != nil {
+			errs = packer.MultiErrorAppend(errs, err)
+			continue
+		}
+		p.config.LocalConfigurationManager[k] = value
+	}
+
 	if errs != nil && len(errs.Errors) > 0 {
 		return errs
 	}
@@ -176,21 +624,110 @@ Start-DscConfiguration -Force -Wait -Verbose -Path $StagingPath`
 // Provision the remote machine with DSC
 func (p *Provisioner) Provision(ui packer.Ui, comm packer.Communicator) error {
 	ui.Say("Provisioning with DSC...")
+	p.remoteScripts = nil
+	p.remotePaths = nil
+	p.summary = provisionSummary{}
+	p.dscRunning = false
+	start := time.Now()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	p.cancelLock.Lock()
+	p.cancel = cancel
+	p.cancelLock.Unlock()
+
+	// Cancel stops the run through ctx, so the total timeout is applied
+	// to a child context to tell the two apart
+	runCtx := ctx
+	if p.config.TotalTimeout > 0 {
+		var cancelRun context.CancelFunc
+		runCtx, cancelRun = context.WithTimeout(ctx, p.config.TotalTimeout)
+		defer cancelRun()
+	}
+
+	err := p.provision(runCtx, ui, comm)
+	if err != nil && ctx.Err() == nil && runCtx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("Provisioning did not complete within the total_timeout of %s", p.config.TotalTimeout)
+	}
+	if err != nil && p.config.CleanupOnFailure && ctx.Err() == nil {
+		// Don't leave configuration data, which may contain secrets, on
+		// the machine. The original error is more useful than any from
+		// the cleanup, which is only logged. runCtx may have expired, so
+		// the cleanup uses ctx.
+		if stopErr := p.stopAbandonedDsc(ctx, ui, comm); stopErr != nil {
+			p.logf("warn", "Error stopping DSC, leaving uploaded files in place: %s", stopErr)
+		} else {
+			ui.Message("Provisioning failed, removing uploaded files...")
+			if cleanupErr := p.cleanup(ctx, ui, comm); cleanupErr != nil {
+				p.logf("warn", "Error cleaning up after failed DSC run: %s", cleanupErr)
+			}
+		}
+	}
+
+	if p.config.OutputJSON != "" {
+		if summaryErr := p.writeSummary(start, err); summaryErr != nil {
+			if err != nil {
+				p.logf("warn", "Error writing output_json: %s", summaryErr)
+			} else {
+				err = fmt.Errorf("Error writing output_json: %s", summaryErr)
+			}
+		}
+	}
+
+	return err
+}
+
+// provision uploads and runs DSC on the remote machine
+func (p *Provisioner) provision(ctx context.Context, ui packer.Ui, comm packer.Communicator) error {
+	if p.config.MinPowerShellVersion != "" {
+		if err := p.checkPowerShellVersion(ctx, ui, comm); err != nil {
+			return fmt.Errorf("Error checking PowerShell version: %s", err)
+		}
+	}
+
+	if !p.config.SkipPreflight {
+		if err := p.checkDscModule(ctx, ui, comm); err != nil {
+			return fmt.Errorf("Error checking DSC is available: %s", err)
+		}
+	}
+
+	// Creating the staging directory creates temp_dir if it's within it
+	if !strings.HasPrefix(p.config.StagingDir, p.config.TempDir+"/") {
+		ui.Message("Creating temporary directory...")
+		if err := p.createDir(ctx, ui, comm, p.config.TempDir); err != nil {
+			return fmt.Errorf("Error creating temp_dir: %s", err)
+		}
+	}
+
 	ui.Message("Creating DSC staging directory...")
-	if err := p.createDir(ui, comm, p.config.StagingDir); err != nil {
+	if err := p.createDir(ctx, ui, comm, p.config.StagingDir); err != nil {
 		return fmt.Errorf("Error creating staging directory: %s", err)
 	}
 
+	if err := p.runPreApply(ctx, ui, comm); err != nil {
+		return fmt.Errorf("Error running pre-apply hook: %s", err)
+	}
+
 	// Install PackageManagement
 	if p.config.InstallPackageManagement {
-		p.installPackageManagement(ui, comm)
+		if err := p.installPackageManagement(ctx, ui, comm); err != nil {
+			return fmt.Errorf("Error installing Package Management: %s", err)
+		}
+	}
+
+	// Configure the Local Configuration Manager
+	if len(p.config.LocalConfigurationManager) > 0 || p.config.PullServerURL != "" || len(p.config.PartialConfigurations) > 0 {
+		if err := p.configureLCM(ctx, ui, comm); err != nil {
+			return fmt.Errorf("Error configuring the Local Configuration Manager: %s", err)
+		}
 	}
 
 	// Upload configuration_params config if set
 	remoteConfigurationFilePath := ""
 	if p.config.ConfigurationFilePath != "" {
 		var err error
-		remoteConfigurationFilePath, err = p.uploadConfigurationFile(ui, comm)
+		remoteConfigurationFilePath, err = p.uploadConfigurationFile(ctx, ui, comm)
 		if err != nil {
 			return fmt.Errorf("Error uploading configuration_params config: %s", err)
 		}
@@ -202,15 +739,26 @@ func (p *Provisioner) Provision(ui packer.Ui, comm packer.Communicator) error {
 		ui.Message(fmt.Sprintf(
 			"Uploading manifest directory from: %s", p.config.ManifestDir))
 		remoteManifestDir = fmt.Sprintf("%s/manifest", p.config.StagingDir)
-		err := p.uploadDirectory(ui, comm, remoteManifestDir, p.config.ManifestDir)
+		err := p.uploadDirectory(ctx, ui, comm, remoteManifestDir, p.config.ManifestDir)
 		if err != nil {
 			return fmt.Errorf("Error uploading manifest dir: %s", err)
 		}
 	}
 
+	// Upload the scripts to dot-source before the manifest
+	remoteScriptDir := ""
+	if p.config.ScriptDir != "" {
+		ui.Message(fmt.Sprintf(
+			"Uploading scripts from: %s", p.config.ScriptDir))
+		remoteScriptDir = fmt.Sprintf("%s/scripts", p.config.StagingDir)
+		if err := p.uploadScripts(ctx, ui, comm, remoteScriptDir); err != nil {
+			return fmt.Errorf("Error uploading script_dir: %s", err)
+		}
+	}
+
 	// Install any remote PowerShell modules
 	for k, v := range p.config.InstallModules {
-		err := p.installPackage(ui, comm, k, v)
+		err := p.installPackage(ctx, ui, comm, k, v)
 		if err != nil {
 			return err
 		}
@@ -221,7 +769,7 @@ func (p *Provisioner) Provision(ui packer.Ui, comm packer.Communicator) error {
 	for i, path := range p.config.ModulePaths {
 		ui.Message(fmt.Sprintf("Uploading local modules from: %s", path))
 		targetPath := fmt.Sprintf("%s/module-%d", p.config.StagingDir, i)
-		if err := p.uploadDirectory(ui, comm, targetPath, path); err != nil {
+		if err := p.uploadDirectory(ctx, ui, comm, targetPath, path); err != nil {
 			return fmt.Errorf("Error uploading modules: %s", err)
 		}
 
@@ -232,51 +780,219 @@ func (p *Provisioner) Provision(ui packer.Ui, comm packer.Communicator) error {
 	for _, path := range p.config.ResourcePaths {
 		ui.Message(fmt.Sprintf("Uploading global DSC Resources from: %s", path))
 		targetPath := fmt.Sprintf(`%s\%s`, `${env:programfiles}\WindowsPowershell\Modules`, filepath.Base(path))
-		if err := p.uploadDirectory(ui, comm, targetPath, path); err != nil {
+		if err := p.uploadDirectory(ctx, ui, comm, targetPath, path); err != nil {
 			return fmt.Errorf("Error uploading global DSC Resource: %s", err)
 		}
 	}
 
+	// A node registered with a pull server applies its own Configuration
+	if p.config.PullServerURL != "" {
+		ui.Message(fmt.Sprintf("Registered with DSC pull server: %s", p.config.PullServerURL))
+		return p.cleanupAfterSuccess(ctx, ui, comm)
+	}
+
+	// A -WhatIf run makes no changes, so the pending Configuration is kept
+	if p.config.ClearPendingConfiguration && !p.config.WhatIf {
+		if err := p.clearPendingConfiguration(ctx, ui, comm); err != nil {
+			return fmt.Errorf("Error clearing pending configuration: %s", err)
+		}
+	}
+
 	// Upload pre-generated MOF
 	remoteMofPath := ""
 	if p.config.MofPath != "" {
-		ui.Message(fmt.Sprintf("Uploading local MOF path from: %s", p.config.MofPath))
-		remoteMofPath = fmt.Sprintf("%s/mof", p.config.StagingDir)
-		if err := p.uploadDirectory(ui, comm, remoteMofPath, p.config.MofPath); err != nil {
+		var err error
+		remoteMofPath, err = p.uploadMof(ctx, ui, comm)
+		if err != nil {
 			return fmt.Errorf("Error uploading MOF: %s", err)
 		}
 	}
 
-	// Upload manifest
-	remoteManifestFile, err := p.uploadManifest(ui, comm)
-	if err != nil {
-		return fmt.Errorf("Error uploading manifest: %s", err)
+	// Upload partial configurations, in the order they are published
+	remotePartialPaths := make([]string, 0, len(p.config.PartialConfigurations))
+	for _, partial := range p.config.PartialConfigurations {
+		remotePartialPath, err := p.uploadPartial(ctx, ui, comm, partial)
+		if err != nil {
+			return fmt.Errorf("Error uploading partial configuration %s: %s", partial.Name, err)
+		}
+		remotePartialPaths = append(remotePartialPaths, remotePartialPath)
 	}
 
-	// Compile the configuration variables
-	configurationVars := make([]string, 0, len(p.config.ConfigurationParams))
-	for k, v := range p.config.ConfigurationParams {
-		if v == "" {
-			configurationVars = append(configurationVars, fmt.Sprintf(`%s `, k))
-		} else {
-			configurationVars = append(configurationVars, fmt.Sprintf(`%s "%s"`, k, v))
+	// Upload manifest
+	remoteManifestFile := ""
+	if p.config.ManifestFile != "" || p.config.InlineManifest != "" {
+		var err error
+		remoteManifestFile, err = p.uploadManifest(ctx, ui, comm)
+		if err != nil {
+			return fmt.Errorf("Error uploading manifest: %s", err)
 		}
 	}
 
 	// Execute DSC script template
 	tmpl := &ExecuteTemplate{
-		ConfigurationParams:   strings.Join(configurationVars, " "),
+		ConfigurationParams:   p.configurationArgs(),
 		ConfigurationFilePath: remoteConfigurationFilePath,
 		ManifestDir:           remoteManifestDir,
+		ScriptDir:             remoteScriptDir,
+		MofOutputPath:         p.config.MofOutputPath,
 		ManifestFile:          remoteManifestFile,
 		ModulePath:            strings.Join(modulePaths, ";"),
 		WorkingDir:            p.config.WorkingDir,
 		ConfigurationName:     p.config.ConfigurationName,
+		OutputDir:             "staging",
 		MofPath:               remoteMofPath,
+		PartialPaths:          strings.Join(remotePartialPaths, ";"),
+		WhatIf:                p.config.WhatIf,
+		Verbose:               p.config.Verbose,
+		PowerShell:            p.powershellExecutable(),
+	}
+
+	if p.config.PreExecuteCommand != "" {
+		ui.Message("Running pre_execute_command...")
+		if err := p.runHook(ctx, ui, comm, "pre_execute_command", p.createFlattenedEnvVars()+p.config.PreExecuteCommand); err != nil {
+			return fmt.Errorf("Error running pre_execute_command: %s", err)
+		}
+	}
+
+	err := p.applyConfigurations(ctx, ui, comm, tmpl)
+	if p.config.PostExecuteCommand != "" && (err == nil || p.config.RunPostOnFailure) {
+		ui.Message("Running post_execute_command...")
+		if postErr := p.runHook(ctx, ui, comm, "post_execute_command", p.createFlattenedEnvVars()+p.config.PostExecuteCommand); postErr != nil {
+			// The DSC error is the more useful one to return
+			if err != nil {
+				p.logf("warn", "Error running post_execute_command after DSC failed: %s", postErr)
+			} else {
+				err = fmt.Errorf("Error running post_execute_command: %s", postErr)
+			}
+		}
+	}
+	if err != nil {
+		return err
 	}
 
+	// A -WhatIf run makes no changes, so there are none to report
+	if (p.config.ReportStatus || p.config.FailIfNoChanges) && !p.config.WhatIf {
+		if err := p.checkChanges(ctx, ui, comm); err != nil {
+			return fmt.Errorf("Error checking for DSC changes: %s", err)
+		}
+		if p.config.FailIfNoChanges && p.summary.Changed != nil && !*p.summary.Changed {
+			return fmt.Errorf("DSC made no changes, and fail_if_no_changes is set")
+		}
+	}
+
+	if p.config.VerifyAfterApply && !p.config.WhatIf {
+		if err := p.verifyConfiguration(ctx, ui, comm); err != nil {
+			return fmt.Errorf("Error verifying DSC configuration: %s", err)
+		}
+	}
+
+	if p.config.OutputMofDirectory != "" {
+		if err := p.downloadMof(ui, comm); err != nil {
+			return fmt.Errorf("Error downloading compiled MOF: %s", err)
+		}
+	}
+
+	// A -WhatIf run makes no changes, so there is no status to report
+	if p.config.ReportPath != "" && !p.config.WhatIf {
+		if err := p.saveReport(ctx, ui, comm); err != nil {
+			return fmt.Errorf("Error saving DSC report: %s", err)
+		}
+	}
+
+	if p.config.StatePath != "" && !p.config.WhatIf {
+		if err := p.saveState(ctx, ui, comm); err != nil {
+			return fmt.Errorf("Error saving DSC state: %s", err)
+		}
+	}
+
+	if p.config.ReportStatus && !p.config.WhatIf {
+		if err := p.reportStatus(ctx, ui, comm); err != nil {
+			return fmt.Errorf("Error reporting DSC status: %s", err)
+		}
+	}
+
+	return p.cleanupAfterSuccess(ctx, ui, comm)
+}
+
+// applyConfigurations applies the Configuration rendered from tmpl, or
+// each of manifest_files in turn
+func (p *Provisioner) applyConfigurations(ctx context.Context, ui packer.Ui, comm packer.Communicator, tmpl *ExecuteTemplate) error {
+	if len(p.config.ManifestFiles) == 0 {
+		return p.applyConfiguration(ctx, ui, comm, tmpl)
+	}
+
+	// Each of manifest_files is compiled into its own directory and
+	// applied in turn, stopping at the first to fail
+	for i, manifest := range p.config.ManifestFiles {
+		name := configurationName(manifest)
+		ui.Say(fmt.Sprintf("Applying DSC Configuration %s...", name))
+
+		remoteManifestFile, err := p.uploadManifestFile(ctx, ui, comm, manifest)
+		if err != nil {
+			return fmt.Errorf("Error uploading manifest: %s", err)
+		}
+
+		configurationTmpl := *tmpl
+		configurationTmpl.ManifestFile = remoteManifestFile
+		configurationTmpl.ConfigurationName = name
+		configurationTmpl.OutputDir = "staging/" + name
+		if p.config.MofOutputPath != "" {
+			configurationTmpl.MofOutputPath = p.config.MofOutputPath + "/" + name
+		}
+		if err := p.applyConfiguration(ctx, ui, comm, &configurationTmpl); err != nil {
+			return fmt.Errorf("Error applying %s: %s", name, err)
+		}
+
+		// DSC only reports the status of the last run, so each run but
+		// the last, which is checked by provision, is checked here
+		if i < len(p.config.ManifestFiles)-1 {
+			if err := p.checkRun(ctx, ui, comm); err != nil {
+				return fmt.Errorf("Error applying %s: %s", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// checkRun checks the status of the DSC run which has just completed,
+// recording whether it made any changes
+func (p *Provisioner) checkRun(ctx context.Context, ui packer.Ui, comm packer.Communicator) error {
+	// A -WhatIf run makes no changes, so there is no status to report
+	if p.config.WhatIf {
+		return nil
+	}
+
+	if p.config.ReportStatus || p.config.FailIfNoChanges {
+		if err := p.checkChanges(ctx, ui, comm); err != nil {
+			return fmt.Errorf("Error checking for DSC changes: %s", err)
+		}
+	}
+
+	if p.config.ReportStatus {
+		if err := p.reportStatus(ctx, ui, comm); err != nil {
+			return fmt.Errorf("Error reporting DSC status: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// applyConfiguration renders the DSC runner from tmpl, then uploads and
+// runs it, handling any reboots DSC requests
+func (p *Provisioner) applyConfiguration(ctx context.Context, ui packer.Ui, comm packer.Communicator, tmpl *ExecuteTemplate) error {
 	p.config.ctx.Data = tmpl
 
+	if p.config.Debug {
+		mofPath := tmpl.MofPath
+		if mofPath == "" {
+			mofPath = tmpl.MofOutputPath
+		}
+		if mofPath == "" {
+			mofPath = fmt.Sprintf("%s/%s", p.config.WorkingDir, tmpl.OutputDir)
+		}
+		p.logf("info", "DSC MOF path: %s", mofPath)
+	}
+
 	// Create the DSC script
 	runner, err := p.createDscScript(*tmpl)
 	if err != nil {
@@ -284,119 +1000,616 @@ func (p *Provisioner) Provision(ui packer.Ui, comm packer.Communicator) error {
 	}
 
 	// Upload runner to temporary remote path
-	remoteScriptPath, err := p.uploadDscRunner(ui, comm, runner)
+	remoteScriptPath, err := p.uploadDscRunner(ctx, ui, comm, runner)
 	if err != nil {
 		return fmt.Errorf("Error uploading DSC runner: %s", err)
 	}
 
-	// Return command to run the DSC Runner
-	command := fmt.Sprintf(powershellTemplate, remoteScriptPath)
-	cmd := &packer.RemoteCmd{
-		Command: command,
+	return p.runDsc(ctx, ui, comm, remoteScriptPath)
+}
+
+// createDscScript renders the DSC runner from execute_command
+func (p *Provisioner) createDscScript(tpml ExecuteTemplate) (string, error) {
+	command, err := interpolate.Render(p.config.ExecuteCommand, &p.config.ctx)
+
+	if err != nil {
+		return "", err
 	}
 
-	ui.Message(fmt.Sprintf("Running DSC: %s", command))
-	if err := cmd.StartWithUi(comm, ui); err != nil {
-		return err
+	// Debug messages are shown rather than prompted for, as -Debug
+	// would, since the session is non-interactive
+	if p.config.Debug {
+		command = debugPreference + command
 	}
 
-	if cmd.ExitStatus != 0 && cmd.ExitStatus != 2 && !p.config.IgnoreExitCodes {
-		return fmt.Errorf("DSC exited with a non-zero exit status: %d", cmd.ExitStatus)
+	// Environment variables are set before anything else is run
+	command = p.createFlattenedEnvVars() + command
+
+	if p.config.Debug {
+		p.logf("info", "Rendered DSC runner:\n%s", command)
 	}
 
-	if p.config.CleanStagingDir {
-		if err := p.removeDir(ui, comm, p.config.StagingDir); err != nil {
-			return fmt.Errorf("Error removing staging directory: %s", err)
+	return command, nil
+}
+
+// checkSources checks that exactly one source of a Configuration is
+// specified, and that the settings used to compile a manifest are only
+// given along with a manifest. A single error lists every conflicting setting.
+func (p *Provisioner) checkSources() error {
+	var sources []string
+	if p.config.ManifestFile != "" {
+		sources = append(sources, "manifest_file")
+	}
+	if len(p.config.ManifestFiles) > 0 {
+		sources = append(sources, "manifest_files")
+	}
+	if p.config.InlineManifest != "" {
+		sources = append(sources, "inline_manifest")
+	}
+	if p.config.MofPath != "" {
+		sources = append(sources, "mof_path")
+	}
+	if len(p.config.PartialConfigurations) > 0 {
+		sources = append(sources, "partial_configurations")
+	}
+	if p.config.PullServerURL != "" {
+		sources = append(sources, "pull_server_url")
+	}
+	if len(sources) == 0 {
+		return fmt.Errorf("A manifest_file, manifest_files, inline_manifest, mof_path, partial_configurations or pull_server_url must be specified.")
+	}
+
+	conflicts := sources
+	if p.config.ManifestFile == "" && len(p.config.ManifestFiles) == 0 && p.config.InlineManifest == "" {
+		if p.config.ConfigurationFilePath != "" {
+			conflicts = append(conflicts, "configuration_file")
+		}
+		if len(p.config.ConfigurationParams) > 0 {
+			conflicts = append(conflicts, "configuration_params")
+		}
+		if p.config.ScriptDir != "" {
+			conflicts = append(conflicts, "script_dir")
+		}
+		if p.config.OutputMofDirectory != "" {
+			conflicts = append(conflicts, "output_mof_directory")
+		}
+		if p.config.MofOutputPath != "" {
+			conflicts = append(conflicts, "mof_output_path")
 		}
 	}
-	return nil
+	if len(conflicts) == 1 {
+		return nil
+	}
+
+	return fmt.Errorf("Conflicting settings: %s. Only one of manifest_file, manifest_files, "+
+		"inline_manifest, mof_path, partial_configurations or pull_server_url may be specified, "+
+		"and configuration_file, configuration_params, script_dir, output_mof_directory and "+
+		"mof_output_path require a manifest.", strings.Join(conflicts, ", "))
 }
 
-func (p *Provisioner) createDscScript(tpml ExecuteTemplate) (string, error) {
-	command, err := interpolate.Render(p.config.ExecuteCommand, &p.config.ctx)
+// configurationName returns the name of the Configuration in the
+// manifest at path, its base name, e.g. "Foo.ps1" becomes "Foo"
+func configurationName(path string) string {
+	return strings.Split(filepath.Base(path), ".")[0]
+}
 
-	if err != nil {
-		return "", err
+// isMofFile reports whether path names a MOF file, catching a manifest
+// or configuration data file given as a mof_path by mistake
+func isMofFile(path string) bool {
+	return strings.EqualFold(filepath.Ext(path), ".mof")
+}
+
+// configurationArgs returns the arguments to the DSC Configuration from
+// configuration_params, in sorted order. Values are single-quoted, so
+// they are passed literally, and parameters without a value are passed
+// as switches.
+func (p *Provisioner) configurationArgs() string {
+	keys := make([]string, 0, len(p.config.ConfigurationParams))
+	for k := range p.config.ConfigurationParams {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return strings.TrimPrefix(keys[i], "-") < strings.TrimPrefix(keys[j], "-")
+	})
+
+	args := make([]string, 0, len(keys))
+	for _, k := range keys {
+		name := "-" + strings.TrimPrefix(k, "-")
+		if v := p.config.ConfigurationParams[k]; v != "" {
+			args = append(args, fmt.Sprintf("%s '%s'", name, singleQuoteEscaper.Replace(v)))
+		} else {
+			args = append(args, name)
+		}
 	}
 
-	file, err := ioutil.TempFile("/tmp", "packer-dsc-runner")
+	return strings.Join(args, " ")
+}
+
+// readVarsFile reads the key=value pairs from an environment variables
+// file, skipping blank lines and comments
+func readVarsFile(path string) ([]string, error) {
+	data, err := ioutil.ReadFile(path)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+
+	var vars []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		vars = append(vars, line)
+	}
+
+	return vars, nil
+}
+
+// powershellExecutable returns the PowerShell executable to run, quoted
+// if the path contains spaces
+func (p *Provisioner) powershellExecutable() string {
+	if strings.Contains(p.config.PowerShellExecutable, " ") {
+		return fmt.Sprintf(`"%s"`, p.config.PowerShellExecutable)
+	}
+	return p.config.PowerShellExecutable
+}
+
+// powershellCommand returns the command to run the given PowerShell
+// statements under the configured execution policy
+func (p *Provisioner) powershellCommand(script string) string {
+	return fmt.Sprintf(powershellTemplate, p.powershellExecutable(), p.config.ExecutionPolicy, script)
+}
+
+// createFlattenedEnvVars returns the PowerShell statements setting
+// each environment variable, in sorted order.
+func (p *Provisioner) createFlattenedEnvVars() (flattened string) {
+	envVars := make(map[string]string)
+
+	// Packer provided env vars, unless disabled
+	if !p.config.SkipPackerVars {
+		envVars["PACKER_BUILD_NAME"] = p.config.PackerBuildName
+		envVars["PACKER_BUILDER_TYPE"] = p.config.PackerBuilderType
+	}
+
+	// Split vars into key/value components
+	for _, envVar := range p.config.Vars {
+		keyValue := strings.SplitN(envVar, "=", 2)
+		envVars[keyValue[0]] = keyValue[1]
+	}
+
+	keys := make([]string, 0, len(envVars))
+	for k := range envVars {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		flattened += fmt.Sprintf(envVarFormat, key, singleQuoteEscaper.Replace(envVars[key]))
+	}
+	return
+}
+
+// retryable will retry the given function over and over until a
+// non-error is returned, or f returns a fatalError. The interval between
+// attempts grows by retry_backoff_multiplier, up to retry_max_interval.
+// Retrying stops at start_retry_timeout, or after max_retries attempts.
+func (p *Provisioner) retryable(ctx context.Context, f func() error) error {
+	start := time.Now()
+	startTimeout := time.After(p.config.StartRetryTimeout)
+	interval := p.config.RetryInterval
+	if interval <= 0 {
+		interval = retryableSleep
+	}
+
+	for attempt := 1; ; attempt++ {
+		var err error
+		if err = f(); err == nil {
+			return nil
+		}
+
+		// Errors that can't be fixed by retrying are returned straight
+		// away, rather than once the retry timeout is reached
+		if fatal, ok := err.(*fatalError); ok {
+			return fatal.err
+		}
+
+		// Create an error and log it
+		err = fmt.Errorf("Retryable error: %s", err)
+		p.logf("debug", "%s", err)
+
+		giveUp := fmt.Errorf("%s (gave up after %d attempts in %s)",
+			err, attempt, time.Since(start).Round(time.Millisecond))
+		if p.config.MaxRetries > 0 && attempt >= p.config.MaxRetries {
+			return giveUp
+		}
+
+		// Check if we timed out, otherwise we retry
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-startTimeout:
+			return giveUp
+		case <-time.After(interval):
+		}
+
+		if p.config.RetryBackoffMultiplier > 1 {
+			interval = time.Duration(float64(interval) * p.config.RetryBackoffMultiplier)
+			if p.config.RetryMaxInterval > 0 && interval > p.config.RetryMaxInterval {
+				interval = p.config.RetryMaxInterval
+			}
+		}
 	}
-	err = ioutil.WriteFile(file.Name(), []byte(command), 0655)
+}
+
+// fatalError wraps an error that retrying won't fix, so that retryable
+// returns it without waiting for the retry timeout
+type fatalError struct {
+	err error
+}
+
+func (e *fatalError) Error() string {
+	return e.err.Error()
+}
 
-	return file.Name(), err
+// Substrings of the errors returned by the WinRM and SSH communicators
+// when the credentials are rejected
+var authErrors = []string{
+	"http response error: 401",
+	"http error 401",
+	"ssh: unable to authenticate",
 }
 
-// Cancel a running DSC session. This is a no-op
+// The WinRM fault returned when a request is larger than the quota
+var envelopeSizeError = "MaxEnvelopeSize"
+
+// Matches the HTTP status in the errors returned by the WinRM communicator
+var httpStatusRegexp = regexp.MustCompile(`http (?:response )?error:? (\d{3})`)
+
+// The exit statuses of the DSC runner treated as success by default
+var defaultValidExitCodes = []int{0, 2}
+
+// The HTTP statuses retried by default, returned by WinRM while the
+// machine is starting up
+var defaultRetryableStatusCodes = []int{500, 502, 503, 504}
+
+// communicatorError marks err as fatal if it is an authentication
+// failure, a request over the WinRM MaxEnvelopeSize quota or an HTTP
+// status not in retryable_status_codes, which won't succeed however
+// often they are retried
+func (p *Provisioner) communicatorError(err error) error {
+	if strings.Contains(err.Error(), envelopeSizeError) {
+		return &fatalError{err: fmt.Errorf("%s\n\nThe request exceeded the WinRM MaxEnvelopeSize quota. "+
+			"Raise the quota on the remote host, e.g. with "+
+			"'winrm set winrm/config @{MaxEnvelopeSizekb=\"8192\"}', "+
+			"or reduce the size of the request, e.g. with chunked_upload.", err)}
+	}
+
+	for _, s := range authErrors {
+		if strings.Contains(err.Error(), s) {
+			return &fatalError{err: err}
+		}
+	}
+
+	if m := httpStatusRegexp.FindStringSubmatch(err.Error()); m != nil {
+		status, _ := strconv.Atoi(m[1])
+		for _, code := range p.config.RetryableStatusCodes {
+			if code == status {
+				return err
+			}
+		}
+		return &fatalError{err: err}
+	}
+	return err
+}
+
+// Cancel a running DSC session. The context of Provision is cancelled,
+// so it stops waiting on the remote host and returns; the communicator
+// has no means of stopping a remote command, so DSC may keep running on
+// the other side.
 func (p *Provisioner) Cancel() {
-	// Just hard quit. It isn't a big deal if what we're doing keeps
-	// running on the other side.
-	os.Exit(0)
+	p.cancelLock.Lock()
+	defer p.cancelLock.Unlock()
+
+	if p.cancel != nil {
+		p.cancel()
+	}
 }
 
-func (p *Provisioner) uploadConfigurationFile(ui packer.Ui, comm packer.Communicator) (string, error) {
+func (p *Provisioner) uploadConfigurationFile(ctx context.Context, ui packer.Ui, comm packer.Communicator) (string, error) {
 	ui.Message("Uploading configuration parameters...")
-	f, err := os.Open(p.config.ConfigurationFilePath)
-	if err != nil {
-		return "", err
-	}
-	defer f.Close()
 
 	path := fmt.Sprintf("%s/%s", p.config.StagingDir, p.config.ConfigurationFilePath)
-	if err := comm.Upload(path, f, nil); err != nil {
+	if err := p.uploadScript(ctx, ui, comm, path, p.config.ConfigurationFilePath); err != nil {
 		return "", err
 	}
 
 	return path, nil
 }
 
-func (p *Provisioner) uploadManifest(ui packer.Ui, comm packer.Communicator) (string, error) {
+func (p *Provisioner) uploadManifest(ctx context.Context, ui packer.Ui, comm packer.Communicator) (string, error) {
+	if p.config.InlineManifest == "" {
+		return p.uploadManifestFile(ctx, ui, comm, p.config.ManifestFile)
+	}
+
+	// An inline manifest is written to a temporary file, named after the
+	// Configuration, and uploaded in the same way
+	ui.Message("Uploading inline manifest...")
+	dir, err := ioutil.TempDir("", "packer-dsc-manifest")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, p.config.ConfigurationName+".ps1")
+	if err := ioutil.WriteFile(path, []byte(p.config.InlineManifest), 0644); err != nil {
+		return "", err
+	}
+	return p.uploadManifestFile(ctx, ui, comm, path)
+}
+
+// uploadManifestFile uploads the manifest at path into the manifest
+// directory, returning its remote path
+func (p *Provisioner) uploadManifestFile(ctx context.Context, ui packer.Ui, comm packer.Communicator, path string) (string, error) {
 	// Create the remote manifest directory...
 	ui.Message("Uploading manifest...")
 	remoteManifestDir := fmt.Sprintf("%s/manifest", p.config.StagingDir)
-	if err := p.createDir(ui, comm, remoteManifestDir); err != nil {
+	if err := p.createDir(ctx, ui, comm, remoteManifestDir); err != nil {
 		return "", fmt.Errorf("Error creating manifest directory: %s", err)
 	}
 
-	ui.Message(fmt.Sprintf("Uploading manifest file from: %s", p.config.ManifestFile))
-
-	f, err := os.Open(p.config.ManifestFile)
-	if err != nil {
-		return "", err
-	}
-	defer f.Close()
+	ui.Message(fmt.Sprintf("Uploading manifest file from: %s", path))
 
-	manifestFilename := filepath.Base(p.config.ManifestFile)
+	manifestFilename := filepath.Base(path)
 	remoteManifestFile := fmt.Sprintf("%s/%s", remoteManifestDir, manifestFilename)
-	if err := comm.Upload(remoteManifestFile, f, nil); err != nil {
+	if err := p.uploadScript(ctx, ui, comm, remoteManifestFile, path); err != nil {
 		return "", err
 	}
 	return remoteManifestFile, nil
 }
 
-func (p *Provisioner) uploadDscRunner(ui packer.Ui, comm packer.Communicator, file string) (string, error) {
-	ui.Message(fmt.Sprintf("Uploading DSC runner from: %s", file))
+// uploadScripts uploads every .ps1 file beneath script_dir to dst,
+// preserving the directory structure.
+func (p *Provisioner) uploadScripts(ctx context.Context, ui packer.Ui, comm packer.Communicator, dst string) error {
+	created := make(map[string]bool)
+	return filepath.Walk(p.config.ScriptDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !strings.EqualFold(filepath.Ext(path), ".ps1") {
+			return nil
+		}
+
+		rel, err := filepath.Rel(p.config.ScriptDir, path)
+		if err != nil {
+			return err
+		}
+
+		remotePath := fmt.Sprintf("%s/%s", dst, filepath.ToSlash(rel))
+		remoteDir := remotePath[:strings.LastIndex(remotePath, "/")]
+		if !created[remoteDir] {
+			if err := p.createDir(ctx, ui, comm, remoteDir); err != nil {
+				return err
+			}
+			created[remoteDir] = true
+		}
+
+		return p.uploadScript(ctx, ui, comm, remotePath, path)
+	})
+}
+
+// uploadMof uploads the pre-generated MOF file, or directory of MOF
+// files, returning the remote directory containing them.
+func (p *Provisioner) uploadMof(ctx context.Context, ui packer.Ui, comm packer.Communicator) (string, error) {
+	ui.Message(fmt.Sprintf("Uploading local MOF path from: %s", p.config.MofPath))
+	remoteMofPath := fmt.Sprintf("%s/mof", p.config.StagingDir)
+
+	return remoteMofPath, p.uploadMofPath(ctx, ui, comm, remoteMofPath, p.config.MofPath, filepath.Base(p.config.MofPath))
+}
+
+// uploadPartial uploads the MOF of a partial configuration, returning
+// the remote directory to publish it from. A single MOF is renamed to
+// localhost.mof, as Publish-DscConfiguration requires.
+func (p *Provisioner) uploadPartial(ctx context.Context, ui packer.Ui, comm packer.Communicator, partial PartialConfiguration) (string, error) {
+	ui.Message(fmt.Sprintf("Uploading partial configuration %s from: %s", partial.Name, partial.MofPath))
+	remotePartialPath := fmt.Sprintf("%s/partials/%s", p.config.StagingDir, partial.Name)
+
+	return remotePartialPath, p.uploadMofPath(ctx, ui, comm, remotePartialPath, partial.MofPath, "localhost.mof")
+}
 
-	f, err := os.Open(file)
+// uploadMofPath uploads the MOF file, or directory of MOF files, at src
+// into the remote directory dst. A single file is uploaded as name.
+func (p *Provisioner) uploadMofPath(ctx context.Context, ui packer.Ui, comm packer.Communicator, dst string, src string, name string) error {
+	info, err := os.Stat(src)
 	if err != nil {
-		return "", err
+		return err
+	}
+
+	if info.IsDir() {
+		return p.uploadDirectory(ctx, ui, comm, dst, src)
+	}
+
+	if err := p.createDir(ctx, ui, comm, dst); err != nil {
+		return err
+	}
+
+	return p.uploadFile(ctx, ui, comm, fmt.Sprintf("%s/%s", dst, name), src)
+}
+
+// downloadMof downloads the MOF files compiled by the runner into
+// output_mof_directory. A meta MOF is only compiled if the Configuration
+// contains LCM settings, so it is not an error for it to be missing.
+func (p *Provisioner) downloadMof(ui packer.Ui, comm packer.Communicator) error {
+	ui.Message(fmt.Sprintf("Downloading compiled MOF to: %s", p.config.OutputMofDirectory))
+	remoteMofPath := p.mofOutputPath()
+
+	if err := p.downloadMofFile(comm, remoteMofPath, "localhost.mof"); err != nil {
+		return err
+	}
+	if err := p.downloadMofFile(comm, remoteMofPath, "localhost.meta.mof"); err != nil {
+		p.logf("debug", "No meta MOF was downloaded: %s", err)
 	}
-	defer f.Close()
+	return nil
+}
 
-	remoteDscFile := fmt.Sprintf("/tmp/%s.ps1", filepath.Base(file))
-	if err := comm.Upload(remoteDscFile, f, nil); err != nil {
+// mofOutputPath returns the remote directory the runner compiles the
+// Configuration into
+func (p *Provisioner) mofOutputPath() string {
+	if p.config.MofOutputPath != "" {
+		return p.config.MofOutputPath
+	}
+	return fmt.Sprintf("%s/staging", p.config.WorkingDir)
+}
+
+// compilesManifest reports whether a manifest is compiled into a MOF,
+// rather than a MOF given or pulled
+func (p *Provisioner) compilesManifest() bool {
+	return p.config.ManifestFile != "" || len(p.config.ManifestFiles) > 0 || p.config.InlineManifest != ""
+}
+
+// withinDir reports whether the remote path is dir or within it,
+// ignoring case and the direction of slashes as Windows does
+func withinDir(path string, dir string) bool {
+	path = strings.ToLower(strings.Replace(path, `\`, "/", -1))
+	dir = strings.ToLower(strings.TrimRight(strings.Replace(dir, `\`, "/", -1), "/"))
+	return path == dir || strings.HasPrefix(path, dir+"/")
+}
+
+// downloadMofFile downloads the named file in the remote directory src into
+// output_mof_directory, removing the local file if the download fails.
+func (p *Provisioner) downloadMofFile(comm packer.Communicator, src string, name string) error {
+	dst := filepath.Join(p.config.OutputMofDirectory, name)
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+
+	err = comm.Download(fmt.Sprintf("%s/%s", src, name), f)
+	f.Close()
+	if err != nil {
+		os.Remove(dst)
+	}
+	return err
+}
+
+// addRemoteScript records a script uploaded outside of the staging
+// directory, so that it is cleaned up and listed in output_json
+func (p *Provisioner) addRemoteScript(path string) {
+	p.remoteScripts = append(p.remoteScripts, path)
+	p.summary.Scripts = append(p.summary.Scripts, path)
+}
+
+// uploadDscRunner uploads the rendered runner, which sets environment_vars
+// and so may hold secrets, straight to the remote host rather than
+// through a local file
+func (p *Provisioner) uploadDscRunner(ctx context.Context, ui packer.Ui, comm packer.Communicator, runner string) (string, error) {
+	remoteDscFile := fmt.Sprintf("%s/packer-dsc-runner-%s.ps1", p.config.TempDir, uuid.TimeOrderedUUID())
+	ui.Message(fmt.Sprintf("Uploading DSC runner to: %s", remoteDscFile))
+
+	if err := p.uploadScriptData(ctx, ui, comm, remoteDscFile, []byte(runner)); err != nil {
 		return "", err
 	}
+	p.addRemoteScript(remoteDscFile)
 	return remoteDscFile, nil
 }
 
-func (p *Provisioner) createDir(ui packer.Ui, comm packer.Communicator, dir string) error {
+// cleanup removes the staging directory, including any compiled MOF
+// files, and the scripts uploaded to run DSC from the remote host
+func (p *Provisioner) cleanup(ctx context.Context, ui packer.Ui, comm packer.Communicator) error {
+	if err := p.removeDir(ctx, ui, comm, p.config.StagingDir); err != nil {
+		return fmt.Errorf("Error removing staging directory: %s", err)
+	}
+
+	// A manifest is compiled within working_dir by default, which needn't
+	// be within the staging directory
+	if mofOutputPath := p.mofOutputPath(); p.compilesManifest() && !withinDir(mofOutputPath, p.config.StagingDir) {
+		if err := p.removeDir(ctx, ui, comm, mofOutputPath); err != nil {
+			return fmt.Errorf("Error removing compiled MOF: %s", err)
+		}
+	}
+
+	for _, script := range p.remoteScripts {
+		if err := p.removeDir(ctx, ui, comm, script); err != nil {
+			return fmt.Errorf("Error removing script %s: %s", script, err)
+		}
+	}
+	p.remoteScripts = nil
+
+	return nil
+}
+
+// cleanupAfterSuccess removes the staging directory if clean_staging_dir
+// is set, or otherwise only what Packer created if cleanup_remote_path is
+func (p *Provisioner) cleanupAfterSuccess(ctx context.Context, ui packer.Ui, comm packer.Communicator) error {
+	if p.config.CleanStagingDir {
+		return p.cleanup(ctx, ui, comm)
+	}
+	if p.config.CleanupRemotePath {
+		return p.cleanupRemotePaths(ctx, ui, comm)
+	}
+	return nil
+}
+
+// cleanupRemotePaths removes the files and directories Packer created
+// within the staging directory, the compiled MOF and the uploaded
+// scripts. The staging directory is only removed itself if it is the
+// default, since one given as staging_dir may be shared.
+func (p *Provisioner) cleanupRemotePaths(ctx context.Context, ui packer.Ui, comm packer.Communicator) error {
+	if p.config.StagingDir == p.config.TempDir+"/packer-dsc-pull" {
+		return p.cleanup(ctx, ui, comm)
+	}
+
+	if mofOutputPath := p.mofOutputPath(); p.compilesManifest() {
+		if withinDir(mofOutputPath, p.config.StagingDir) {
+			p.trackRemotePath(mofOutputPath)
+		} else if err := p.removeDir(ctx, ui, comm, mofOutputPath); err != nil {
+			return fmt.Errorf("Error removing compiled MOF: %s", err)
+		}
+	}
+
+	for _, path := range p.remotePaths {
+		if err := p.removeDir(ctx, ui, comm, path); err != nil {
+			return fmt.Errorf("Error removing %s: %s", path, err)
+		}
+	}
+	p.remotePaths = nil
+
+	for _, script := range p.remoteScripts {
+		if err := p.removeDir(ctx, ui, comm, script); err != nil {
+			return fmt.Errorf("Error removing script %s: %s", script, err)
+		}
+	}
+	p.remoteScripts = nil
+
+	return nil
+}
+
+// trackRemotePath records the entry of the staging directory containing
+// the remote path, if it is within it, for removal by cleanupRemotePaths
+func (p *Provisioner) trackRemotePath(remotePath string) {
+	dir := path.Clean(strings.Replace(p.config.StagingDir, `\`, "/", -1))
+	remotePath = path.Clean(strings.Replace(remotePath, `\`, "/", -1))
+	if !withinDir(remotePath, dir) || len(remotePath) == len(dir) {
+		return
+	}
+
+	name := strings.SplitN(remotePath[len(dir)+1:], "/", 2)[0]
+	entry := dir + "/" + name
+	for _, tracked := range p.remotePaths {
+		if tracked == entry {
+			return
+		}
+	}
+	p.remotePaths = append(p.remotePaths, entry)
+}
+
+func (p *Provisioner) createDir(ctx context.Context, ui packer.Ui, comm packer.Communicator, dir string) error {
+	p.trackRemotePath(dir)
+
 	cmd := &packer.RemoteCmd{
-		Command: fmt.Sprintf("powershell.exe -Command \"New-Item -ItemType directory -Force -ErrorAction SilentlyContinue -Path %s\"", dir),
+		Command: fmt.Sprintf("%s -Command \"New-Item -ItemType directory -Force -ErrorAction SilentlyContinue -Path %s\"", p.powershellExecutable(), dir),
 	}
 
-	if err := cmd.StartWithUi(comm, ui); err != nil {
+	if err := p.runCommand(ctx, ui, comm, cmd); err != nil {
 		return err
 	}
 
@@ -407,12 +1620,15 @@ func (p *Provisioner) createDir(ui packer.Ui, comm packer.Communicator, dir stri
 	return nil
 }
 
-func (p *Provisioner) removeDir(ui packer.Ui, comm packer.Communicator, dir string) error {
+// removeDir removes the remote file or directory, if it still exists.
+// Remove-Item fails the command for a missing path even with
+// -ErrorAction SilentlyContinue, so its existence is checked first.
+func (p *Provisioner) removeDir(ctx context.Context, ui packer.Ui, comm packer.Communicator, dir string) error {
 	cmd := &packer.RemoteCmd{
-		Command: fmt.Sprintf("powershell.exe -Command \"Remove-Item '%s' -Recurse -Force\"", dir),
+		Command: fmt.Sprintf("%s -Command \"if (Test-Path '%s') { Remove-Item '%s' -Recurse -Force }\"", p.powershellExecutable(), dir, dir),
 	}
 
-	if err := cmd.StartWithUi(comm, ui); err != nil {
+	if err := p.runCommand(ctx, ui, comm, cmd); err != nil {
 		return err
 	}
 
@@ -433,7 +1649,7 @@ var installTemplate = `
 `
 
 // Install a package on the remote host
-func (p *Provisioner) installPackageManagement(ui packer.Ui, comm packer.Communicator) error {
+func (p *Provisioner) installPackageManagement(ctx context.Context, ui packer.Ui, comm packer.Communicator) error {
 	ui.Message("Installing PowerShell Package Management")
 
 	// Inject template variables
@@ -442,55 +1658,264 @@ func (p *Provisioner) installPackageManagement(ui packer.Ui, comm packer.Communi
 		return err
 	}
 
-	// Upload script
-	file, err := ioutil.TempFile("/tmp", "packer-dsc-packagemanagement")
+	cmd, err := p.runScript(ctx, ui, comm, script, "packer-dsc-packagemanagement")
 	if err != nil {
 		return err
 	}
-	err = ioutil.WriteFile(file.Name(), []byte(script), 0655)
 
-	remoteScriptFile := fmt.Sprintf("/tmp/%s.ps1", filepath.Base(file.Name()))
-	if err := comm.Upload(remoteScriptFile, file, nil); err != nil {
-		return err
+	if cmd.ExitStatus != 0 {
+		return exitError("Install Package Management", cmd)
+	}
+
+	return nil
+}
+
+// runDsc runs the uploaded DSC runner, handling any reboots it requests,
+// and fails if DSC exits with an error
+func (p *Provisioner) runDsc(ctx context.Context, ui packer.Ui, comm packer.Communicator, remoteScriptPath string) error {
+	// Build the command to run the DSC Runner
+	command := p.powershellCommand(remoteScriptPath)
+	if p.config.ElevatedUser != "" {
+		var err error
+		command, err = p.generateElevatedRunner(ctx, ui, comm, remoteScriptPath)
+		if err != nil {
+			return fmt.Errorf("Error generating elevated runner: %s", err)
+		}
 	}
 
-	// Run script
 	cmd := &packer.RemoteCmd{
-		Command: fmt.Sprintf(`powershell "& { %s; exit $LastExitCode}"`, remoteScriptFile),
+		Command: command,
 	}
 
-	if err := cmd.StartWithUi(comm, ui); err != nil {
+	if p.config.WhatIf {
+		ui.Say("Running DSC with -WhatIf, the changes DSC would make are shown below...")
+	}
+
+	// The communicator can't stop a remote command, so a timeout only
+	// stops Packer waiting on it. DSC is stopped before cleanup_on_failure
+	// removes its files.
+	runCtx := ctx
+	if p.config.ExecuteTimeout > 0 {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithTimeout(ctx, p.config.ExecuteTimeout)
+		defer cancel()
+	}
+
+	ui.Message(fmt.Sprintf("Running DSC: %s", command))
+	err := p.runCommand(runCtx, ui, comm, cmd)
+
+	// If runCtx is done, DSC was abandoned and is still running
+	p.dscRunning = err != nil && runCtx.Err() != nil
+	if err != nil {
+		if ctx.Err() == nil && runCtx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("DSC did not complete within the execute_timeout of %s", p.config.ExecuteTimeout)
+		}
+
+		// DSC didn't start, so there is no reboot to handle
+		return err
+	}
+
+	// A restart by a DSC resource is seen as a disconnect, or as a
+	// pending reboot in the LCM state
+	if p.config.RebootNodeIfNeeded {
+		cmd, err = p.handleReboots(ctx, ui, comm, cmd)
+		if err != nil {
+			return fmt.Errorf("Error handling DSC reboot: %s", err)
+		}
+	}
+
+	p.summary.ExitStatus = cmd.ExitStatus
+	if !p.config.IgnoreExitCodes && !p.validExitCode(cmd.ExitStatus) {
+		return exitError("DSC", cmd)
+	}
+
+	return nil
+}
+
+// stopAbandonedDsc stops the DSC run abandoned on a timeout, if any,
+// which would otherwise be left running without its files once they
+// are cleaned up
+func (p *Provisioner) stopAbandonedDsc(ctx context.Context, ui packer.Ui, comm packer.Communicator) error {
+	if !p.dscRunning {
+		return nil
+	}
+
+	ui.Message("Stopping the running DSC Configuration...")
+	if _, err := p.remoteOutput(ctx, comm, p.powershellCommand(stopDscScript)); err != nil {
+		return err
+	}
+	p.dscRunning = false
+	return nil
+}
+
+// validExitCode reports whether DSC exiting with status is a success
+func (p *Provisioner) validExitCode(status int) bool {
+	for _, code := range p.config.ValidExitCodes {
+		if code == status {
+			return true
+		}
+	}
+	return false
+}
+
+// runPreApply runs the pre_apply_inline commands and then the
+// pre_apply_script, with the same environment variables as DSC
+func (p *Provisioner) runPreApply(ctx context.Context, ui packer.Ui, comm packer.Communicator) error {
+	if len(p.config.PreApplyInline) > 0 {
+		ui.Message("Running pre-apply commands...")
+		script := p.createFlattenedEnvVars() + strings.Join(p.config.PreApplyInline, "\n")
+		if err := p.runHook(ctx, ui, comm, "pre_apply_inline", script); err != nil {
+			return err
+		}
+	}
+
+	if p.config.PreApplyScript != "" {
+		ui.Message(fmt.Sprintf("Running pre-apply script: %s", p.config.PreApplyScript))
+		data, err := ioutil.ReadFile(p.config.PreApplyScript)
+		if err != nil {
+			return err
+		}
+		if err := p.runHook(ctx, ui, comm, "pre_apply_script", p.createFlattenedEnvVars()+string(data)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// runHook runs the given script, failing if it exits non-zero. name
+// identifies the hook in the error.
+func (p *Provisioner) runHook(ctx context.Context, ui packer.Ui, comm packer.Communicator, name string, script string) error {
+	cmd, err := p.runScript(ctx, ui, comm, script, "packer-dsc-hook")
+	if err != nil {
+		return err
+	}
+
+	if cmd.ExitStatus != 0 {
+		return exitError(name, cmd)
+	}
+
+	return nil
+}
+
+// clearPendingConfiguration removes any Configuration left pending by an
+// earlier DSC run, which would otherwise stop Start-DscConfiguration
+func (p *Provisioner) clearPendingConfiguration(ctx context.Context, ui packer.Ui, comm packer.Communicator) error {
+	ui.Say("Warning: removing any pending DSC Configuration left by an earlier run")
+
+	cmd, err := p.runScript(ctx, ui, comm, clearPendingScript, "packer-dsc-clear")
+	if err != nil {
+		return err
+	}
+
+	if cmd.ExitStatus != 0 {
+		return exitError("Remove-DscConfigurationDocument", cmd)
+	}
+
+	return nil
+}
+
+// Configure the Local Configuration Manager on the remote host
+func (p *Provisioner) configureLCM(ctx context.Context, ui packer.Ui, comm packer.Communicator) error {
+	ui.Message("Configuring the Local Configuration Manager")
+
+	settings := make(map[string]string)
+	for k, v := range p.config.LocalConfigurationManager {
+		settings[k] = v
+	}
+
+	tmpl := &LCMTemplate{
+		OutputPath: fmt.Sprintf("%s/lcm", p.config.StagingDir),
+	}
+	p.trackRemotePath(tmpl.OutputPath)
+	if p.config.PullServerURL != "" {
+		settings["RefreshMode"] = "Pull"
+
+		names := make([]string, 0, len(p.config.ConfigurationNames))
+		for _, name := range p.config.ConfigurationNames {
+			names = append(names, fmt.Sprintf("'%s'", singleQuoteEscaper.Replace(name)))
+		}
+
+		tmpl.PullServerURL = singleQuoteEscaper.Replace(p.config.PullServerURL)
+		tmpl.RegistrationKey = singleQuoteEscaper.Replace(p.config.RegistrationKey)
+		tmpl.ConfigurationNames = strings.Join(names, ", ")
+		tmpl.AllowUnsecure = strings.HasPrefix(strings.ToLower(p.config.PullServerURL), "http:")
+	}
+	for _, partial := range p.config.PartialConfigurations {
+		dependsOn := make([]string, 0, len(partial.DependsOn))
+		for _, name := range partial.DependsOn {
+			dependsOn = append(dependsOn, fmt.Sprintf("'[PartialConfiguration]%s'", name))
+		}
+		tmpl.Partials = append(tmpl.Partials, LCMPartial{
+			Name:      partial.Name,
+			DependsOn: strings.Join(dependsOn, ", "),
+		})
+	}
+	tmpl.Settings = lcmSettingLines(settings)
+
+	p.config.ctx.Data = tmpl
+	script, err := interpolate.Render(lcmTemplate, &p.config.ctx)
+	if err != nil {
+		return err
+	}
+
+	cmd, err := p.runScript(ctx, ui, comm, script, "packer-dsc-lcm")
+	if err != nil {
 		return err
 	}
 
 	if cmd.ExitStatus != 0 {
-		return fmt.Errorf("Install Package Management return a non-zero exit status: %d", cmd.ExitStatus)
+		return exitError("Set-DscLocalConfigurationManager", cmd)
 	}
 
 	return nil
 }
 
+// Upload the given script to a temporary remote path and run it
+func (p *Provisioner) runScript(ctx context.Context, ui packer.Ui, comm packer.Communicator, script string, prefix string) (*packer.RemoteCmd, error) {
+	remoteScriptFile := fmt.Sprintf("%s/%s-%s.ps1", p.config.TempDir, prefix, uuid.TimeOrderedUUID())
+	if err := p.upload(ctx, ui, comm, remoteScriptFile, []byte(script)); err != nil {
+		return nil, err
+	}
+	p.addRemoteScript(remoteScriptFile)
+
+	cmd := &packer.RemoteCmd{
+		Command: p.powershellCommand(remoteScriptFile),
+	}
+
+	if err := p.runCommand(ctx, ui, comm, cmd); err != nil {
+		return nil, err
+	}
+
+	return cmd, nil
+}
+
 // Install a package on the remote host
-func (p *Provisioner) installPackage(ui packer.Ui, comm packer.Communicator, pkg string, version string) error {
+func (p *Provisioner) installPackage(ctx context.Context, ui packer.Ui, comm packer.Communicator, pkg string, version string) error {
 	ui.Message(fmt.Sprintf("Installing PowerShell package '%s'", pkg))
 
+	install := fmt.Sprintf("Install-Module -Name %s -Force", pkg)
+	if version != "" {
+		install = fmt.Sprintf("Install-Module -Name %s -RequiredVersion %s -Force", pkg, version)
+	}
+
 	cmd := &packer.RemoteCmd{
-		Command: fmt.Sprintf(powershellTemplate, fmt.Sprintf("Install-Module -Name %s -RequiredVersion %s -Force", pkg, version)),
+		Command: p.powershellCommand(install),
 	}
 
-	if err := cmd.StartWithUi(comm, ui); err != nil {
+	if err := p.runCommand(ctx, ui, comm, cmd); err != nil {
 		return err
 	}
 
 	if cmd.ExitStatus != 0 {
-		return fmt.Errorf("PowerShell module install exited with a non-zero exit status: %d", cmd.ExitStatus)
+		return exitError("PowerShell module install", cmd)
 	}
 
 	return nil
 }
 
-func (p *Provisioner) uploadDirectory(ui packer.Ui, comm packer.Communicator, dst string, src string) error {
-	if err := p.createDir(ui, comm, dst); err != nil {
+func (p *Provisioner) uploadDirectory(ctx context.Context, ui packer.Ui, comm packer.Communicator, dst string, src string) error {
+	if err := p.createDir(ctx, ui, comm, dst); err != nil {
 		return err
 	}
 
@@ -1,11 +1,22 @@
 package dsc
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
 	"io/ioutil"
+	"log"
 	"os"
+	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/hashicorp/packer/packer"
 )
@@ -21,10 +32,13 @@ func testConfig() map[string]interface{} {
 		}
 	}
 
+	// Most tests inspect the commands run, so the cleanup after a
+	// successful run is left to the tests which enable it
 	return map[string]interface{}{
-		"manifest_file":      filename,
-		"manifest_dir":       ".",
-		"configuration_file": "./provisioner_test.go",
+		"cleanup_remote_path": false,
+		"manifest_file":       filename,
+		"manifest_dir":        ".",
+		"configuration_file":  "./provisioner_test.go",
 		"configuration_params": map[string]string{
 			"-Foo": "bar",
 		},
@@ -281,6 +295,16 @@ func TestProvisionerPrepare_configurationParams(t *testing.T) {
 		t.Fatalf("err: %s", err)
 	}
 
+	// Names must be PowerShell parameter names
+	config["configuration_params"] = map[string]string{
+		"-Website; Remove-Item C:/": "x",
+	}
+	p = new(Provisioner)
+	err = p.Prepare(config)
+	if err == nil {
+		t.Fatal("should be an error")
+	}
+
 	// Make sure the default facts are present
 	delete(config, "configuration_params")
 	p = new(Provisioner)
@@ -303,6 +327,59 @@ func TestProvisionerPrepare_installPackage(t *testing.T) {
 	}
 }
 
+func TestProvisionerPrepare_installModulesInvalid(t *testing.T) {
+	config := testConfig()
+	config["install_modules"] = map[string]string{
+		"SomeModuleName": "latest",
+	}
+	p := new(Provisioner)
+	err := p.Prepare(config)
+	if err == nil {
+		t.Fatal("should have error")
+	}
+
+	config["install_modules"] = map[string]string{
+		"Some Module; rm -r c:/": "1.0.0",
+	}
+	p = new(Provisioner)
+	err = p.Prepare(config)
+	if err == nil {
+		t.Fatal("should have error")
+	}
+
+	config["install_modules"] = map[string]string{
+		"xWebAdministration": "",
+		"xNetworking":        "3.2.0.0",
+	}
+	p = new(Provisioner)
+	err = p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestProvisioner_installPackageLatest(t *testing.T) {
+	config := testConfig()
+	ui := &packer.MachineReadableUi{
+		Writer: ioutil.Discard,
+	}
+	comm := new(packer.MockCommunicator)
+	p := new(Provisioner)
+	err := p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	err = p.installPackage(context.Background(), ui, comm, "SomeModuleName", "")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expectedCommand := `powershell -ExecutionPolicy Bypass -Command "& { Install-Module -Name SomeModuleName -Force; exit $LastExitCode}"`
+	if comm.StartCmd.Command != expectedCommand {
+		t.Fatalf("Expected command '%s' but got '%s'", expectedCommand, comm.StartCmd.Command)
+	}
+}
+
 func TestProvisioner_installPackage(t *testing.T) {
 	config := testConfig()
 	ui := &packer.MachineReadableUi{
@@ -318,12 +395,12 @@ func TestProvisioner_installPackage(t *testing.T) {
 	if err != nil {
 		t.Fatalf("err: %s", err)
 	}
-	err = p.installPackage(ui, comm, "SomeModuleName", "1.0.0")
+	err = p.installPackage(context.Background(), ui, comm, "SomeModuleName", "1.0.0")
 	if err != nil {
 		t.Fatalf("err: %s", err)
 	}
 
-	expectedCommand := `powershell "& { Install-Module -Name SomeModuleName -RequiredVersion 1.0.0 -Force; exit $LastExitCode}"`
+	expectedCommand := `powershell -ExecutionPolicy Bypass -Command "& { Install-Module -Name SomeModuleName -RequiredVersion 1.0.0 -Force; exit $LastExitCode}"`
 	if comm.StartCmd.Command != expectedCommand {
 		t.Fatalf("Expected command '%s' but got '%s'", expectedCommand, comm.StartCmd.Command)
 	}
@@ -348,7 +425,7 @@ func TestProvisioner_installPackageNonZeroExitCode(t *testing.T) {
 	if err != nil {
 		t.Fatalf("err: %s", err)
 	}
-	err = p.installPackage(ui, comm, "SomeModuleName", "1.0.0")
+	err = p.installPackage(context.Background(), ui, comm, "SomeModuleName", "1.0.0")
 	if err == nil {
 		t.Fatalf("Expected error but got none")
 	}
@@ -375,8 +452,8 @@ func TestProvisioner_installPackageManagement(t *testing.T) {
 	ui := &packer.MachineReadableUi{
 		Writer: ioutil.Discard,
 	}
-	comm := new(packer.MockCommunicator)
-	err = p.installPackageManagement(ui, comm)
+	comm := new(testCommunicator)
+	err = p.installPackageManagement(context.Background(), ui, comm)
 	if err != nil {
 		t.Fatalf("Err: %s", err)
 	}
@@ -393,9 +470,10 @@ func TestProvisioner_installPackageManagementFail(t *testing.T) {
 	ui := &packer.MachineReadableUi{
 		Writer: ioutil.Discard,
 	}
-	comm := new(packer.MockCommunicator)
-	comm.StartExitStatus = 2
-	err = p.installPackageManagement(ui, comm)
+	comm := &testCommunicator{
+		ExitStatuses: map[string]int{"packer-dsc-packagemanagement": 2},
+	}
+	err = p.installPackageManagement(context.Background(), ui, comm)
 	if err == nil {
 		t.Fatalf("Expected error but got none")
 	}
@@ -406,13 +484,16 @@ func TestProvisionerProvision_mofFile(t *testing.T) {
 	ui := &packer.MachineReadableUi{
 		Writer: ioutil.Discard,
 	}
-	comm := new(packer.MockCommunicator)
+	comm := new(testCommunicator)
 	mofPath, _ := ioutil.TempDir("/tmp", "packer")
 	defer os.Remove(mofPath)
 
 	config["configuration_name"] = "SomeProjectName"
 	config["mof_path"] = mofPath
 	config["module_paths"] = []string{"."}
+	delete(config, "manifest_file")
+	delete(config, "configuration_file")
+	delete(config, "configuration_params")
 
 	// Test with valid values
 	p := new(Provisioner)
@@ -426,17 +507,12 @@ func TestProvisionerProvision_mofFile(t *testing.T) {
 		t.Fatalf("err: %s", err)
 	}
 
-	s := comm.StartCmd.Command
-	re := regexp.MustCompile(`powershell \"\& \{ ([a-zA-Z0-9-\/]+).*`)
-	command := re.FindStringSubmatch(s)[1]
-
-	bytes, err := ioutil.ReadFile(command)
-	if err != nil {
-		t.Fatalf(err.Error())
-	}
-	scriptContents := strings.TrimSpace(string(bytes))
+	scriptContents := runnerScript(t, comm)
 
 	expectedCommand := `
+$env:PACKER_BUILDER_TYPE = ''
+$env:PACKER_BUILD_NAME = ''
+
 #
 # DSC Runner.
 #
@@ -444,6 +520,9 @@ func TestProvisionerProvision_mofFile(t *testing.T) {
 # and runs the DSC Configuration.
 #
 #
+# Run from the working directory, so relative paths resolve against it
+cd "/tmp/packer-dsc-pull"
+
 # Set the local PowerShell Module environment path
 
 $absoluteModulePaths = [string]::Join(";", ("/tmp/packer-dsc-pull/module-0".Split(";") | ForEach-Object { $_ | Resolve-Path }))
@@ -452,9 +531,7 @@ $env:PSModulePath="$absoluteModulePaths;${env:PSModulePath}"
 ("/tmp/packer-dsc-pull/module-0".Split(";") | ForEach-Object { gci -Recurse  $_ | ForEach-Object { Unblock-File  $_.FullName} })
 
 
-$script = $("/tmp/packer-dsc-pull/manifest/packer-dsc-pull-manifest" | Resolve-Path)
 echo "PSModulePath Configured: ${env:PSModulePath}"
-echo "Running Configuration file: ${script}"
 
 
 $StagingPath = "/tmp/packer-dsc-pull/mof"
@@ -468,95 +545,176 @@ Start-DscConfiguration -Force -Wait -Verbose -Path $StagingPath`
 	}
 }
 
-func TestProvisionerProvision_noConfigurationParams(t *testing.T) {
+func TestProvisionerPrepare_mofPath(t *testing.T) {
 	config := testConfig()
-	ui := &packer.MachineReadableUi{
-		Writer: ioutil.Discard,
+	tf, err := ioutil.TempFile("", "packer*.mof")
+	if err != nil {
+		t.Fatalf("error tempfile: %s", err)
 	}
-	comm := new(packer.MockCommunicator)
-	config["configuration_name"] = "SomeProjectName"
-	config["module_paths"] = []string{"."}
+	defer os.Remove(tf.Name())
+
+	// Conflicts with compiling a Configuration
+	config["mof_path"] = tf.Name()
+	p := new(Provisioner)
+	err = p.Prepare(config)
+	if err == nil || !strings.Contains(err.Error(), "Conflicting settings: manifest_file, mof_path.") {
+		t.Fatalf("Expected manifest_file conflict but got: %v", err)
+	}
+
+	// Does not exist
+	delete(config, "manifest_file")
 	delete(config, "configuration_file")
 	delete(config, "configuration_params")
+	config["mof_path"] = "i/do/not/exist.mof"
+	p = new(Provisioner)
+	err = p.Prepare(config)
+	if err == nil {
+		t.Fatal("should have error")
+	}
 
-	// Test with valid values
-	p := new(Provisioner)
-	err := p.Prepare(config)
-	if err != nil {
-		t.Fatalf("err: %s", err)
+	// Not a MOF
+	config["mof_path"] = "./provisioner_test.go"
+	p = new(Provisioner)
+	err = p.Prepare(config)
+	if err == nil || !strings.Contains(err.Error(), "mof_path must point to a .mof file or a directory") {
+		t.Fatalf("Expected .mof error but got: %v", err)
 	}
 
-	err = p.Provision(ui, comm)
+	// Test with a good one
+	config["mof_path"] = tf.Name()
+	p = new(Provisioner)
+	err = p.Prepare(config)
 	if err != nil {
 		t.Fatalf("err: %s", err)
 	}
+}
 
-	s := comm.StartCmd.Command
-	re := regexp.MustCompile(`powershell \"\& \{ ([a-zA-Z0-9-\/]+).*`)
-	command := re.FindStringSubmatch(s)[1]
-
-	bytes, err := ioutil.ReadFile(command)
+func TestProvisionerPrepare_sources(t *testing.T) {
+	tf, err := ioutil.TempFile("", "packer*.mof")
 	if err != nil {
-		t.Fatalf(err.Error())
+		t.Fatalf("error tempfile: %s", err)
 	}
-	scriptContents := strings.TrimSpace(string(bytes))
-
-	expectedCommand := `
-#
-# DSC Runner.
-#
-# Bootstraps the DSC environment, sets up configuration data
-# and runs the DSC Configuration.
-#
-#
-# Set the local PowerShell Module environment path
-
-$absoluteModulePaths = [string]::Join(";", ("/tmp/packer-dsc-pull/module-0".Split(";") | ForEach-Object { $_ | Resolve-Path }))
-echo "Adding to path: $absoluteModulePaths"
-$env:PSModulePath="$absoluteModulePaths;${env:PSModulePath}"
-("/tmp/packer-dsc-pull/module-0".Split(";") | ForEach-Object { gci -Recurse  $_ | ForEach-Object { Unblock-File  $_.FullName} })
-
-
-$script = $("/tmp/packer-dsc-pull/manifest/packer-dsc-pull-manifest" | Resolve-Path)
-echo "PSModulePath Configured: ${env:PSModulePath}"
-echo "Running Configuration file: ${script}"
-
-
-# Generate the MOF file, only if a MOF path not already provided.
-# Import the Manifest
-. $script
-
-cd "/tmp/packer-dsc-pull"
-$StagingPath = $(Join-Path "/tmp/packer-dsc-pull" "staging")
+	defer os.Remove(tf.Name())
 
-SomeProjectName -OutputPath $StagingPath 
+	manifest := testConfig()["manifest_file"]
+	pullServer := pullServerConfig()
+	cases := []struct {
+		name      string
+		settings  map[string]interface{}
+		conflicts string
+	}{
+		{
+			name:      "manifest and mof",
+			settings:  map[string]interface{}{"manifest_file": manifest, "mof_path": tf.Name()},
+			conflicts: "manifest_file, mof_path",
+		},
+		{
+			name:      "manifest and pull server",
+			settings:  map[string]interface{}{"manifest_file": manifest, "pull_server_url": pullServer["pull_server_url"]},
+			conflicts: "manifest_file, pull_server_url",
+		},
+		{
+			name:      "mof and pull server",
+			settings:  map[string]interface{}{"mof_path": tf.Name(), "pull_server_url": pullServer["pull_server_url"]},
+			conflicts: "mof_path, pull_server_url",
+		},
+		{
+			name: "all sources",
+			settings: map[string]interface{}{
+				"manifest_file":   manifest,
+				"mof_path":        tf.Name(),
+				"pull_server_url": pullServer["pull_server_url"],
+			},
+			conflicts: "manifest_file, mof_path, pull_server_url",
+		},
+		{
+			name:      "mof and configuration file",
+			settings:  map[string]interface{}{"mof_path": tf.Name(), "configuration_file": "./provisioner_test.go"},
+			conflicts: "mof_path, configuration_file",
+		},
+		{
+			name:      "mof and configuration params",
+			settings:  map[string]interface{}{"mof_path": tf.Name(), "configuration_params": map[string]string{"-Foo": "bar"}},
+			conflicts: "mof_path, configuration_params",
+		},
+		{
+			name:      "manifest and manifest files",
+			settings:  map[string]interface{}{"manifest_file": manifest, "manifest_files": []string{manifest.(string)}},
+			conflicts: "manifest_file, manifest_files",
+		},
+		{
+			name:      "manifest and inline manifest",
+			settings:  map[string]interface{}{"manifest_file": manifest, "inline_manifest": "Configuration Inline {}", "configuration_name": "Inline"},
+			conflicts: "manifest_file, inline_manifest",
+		},
+		{
+			name:      "mof and mof output path",
+			settings:  map[string]interface{}{"mof_path": tf.Name(), "mof_output_path": "C:/mof"},
+			conflicts: "mof_path, mof_output_path",
+		},
+		{
+			name:      "mof and script dir",
+			settings:  map[string]interface{}{"mof_path": tf.Name(), "script_dir": "."},
+			conflicts: "mof_path, script_dir",
+		},
+		{
+			name: "pull server and configuration settings",
+			settings: map[string]interface{}{
+				"pull_server_url":      pullServer["pull_server_url"],
+				"configuration_file":   "./provisioner_test.go",
+				"configuration_params": map[string]string{"-Foo": "bar"},
+			},
+			conflicts: "pull_server_url, configuration_file, configuration_params",
+		},
+	}
 
+	for _, tc := range cases {
+		config := pullServerConfig()
+		delete(config, "pull_server_url")
+		for k, v := range tc.settings {
+			config[k] = v
+		}
 
-# Start a DSC Configuration run
-Start-DscConfiguration -Force -Wait -Verbose -Path $StagingPath`
+		p := new(Provisioner)
+		err := p.Prepare(config)
+		expected := "Conflicting settings: " + tc.conflicts + "."
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Fatalf("%s: expected '%s' but got: %v", tc.name, expected, err)
+		}
+	}
 
-	if scriptContents != strings.TrimSpace(expectedCommand) {
-		t.Fatalf("Expected:\n\n%s\n\nbut got: \n\n%s", strings.TrimSpace(expectedCommand), scriptContents)
+	// Nothing to apply
+	config := pullServerConfig()
+	delete(config, "pull_server_url")
+	p := new(Provisioner)
+	err = p.Prepare(config)
+	if err == nil || !strings.Contains(err.Error(), "A manifest_file, manifest_files, inline_manifest, mof_path, partial_configurations or pull_server_url must be specified.") {
+		t.Fatalf("Expected missing source error but got: %v", err)
 	}
 }
 
-func TestProvisionerProvision_configurationParams(t *testing.T) {
+func TestProvisionerProvision_mofFileSingle(t *testing.T) {
 	config := testConfig()
 	ui := &packer.MachineReadableUi{
 		Writer: ioutil.Discard,
 	}
-	comm := new(packer.MockCommunicator)
-	configurationParams := map[string]string{
-		"-Website": "Beanstalk",
+	comm := new(testCommunicator)
+	tf, err := ioutil.TempFile("", "localhost*.mof")
+	if err != nil {
+		t.Fatalf("error tempfile: %s", err)
 	}
-	config["configuration_name"] = "SomeProjectName"
+	defer os.Remove(tf.Name())
+	tf.WriteString("instance of MSFT_Configuration {};")
+	tf.Close()
+
+	config["mof_path"] = tf.Name()
+	config["report_status"] = false
+	delete(config, "manifest_file")
 	delete(config, "configuration_file")
-	config["configuration_params"] = configurationParams
-	config["module_paths"] = []string{"."}
+	delete(config, "configuration_params")
 
-	// Test with valid values
 	p := new(Provisioner)
-	err := p.Prepare(config)
+	err = p.Prepare(config)
 	if err != nil {
 		t.Fatalf("err: %s", err)
 	}
@@ -566,75 +724,3435 @@ func TestProvisionerProvision_configurationParams(t *testing.T) {
 		t.Fatalf("err: %s", err)
 	}
 
-	s := comm.StartCmd.Command
-	re := regexp.MustCompile(`powershell \"\& \{ ([a-zA-Z0-9-\/]+).*`)
-	command := re.FindStringSubmatch(s)[1]
+	if !strings.Contains(runnerScript(t, comm), `$StagingPath = "/tmp/packer-dsc-pull/mof"`) {
+		t.Fatalf("Expected the uploaded MOF to be applied")
+	}
+	if !comm.ran("/tmp/packer-dsc-pull/mof") {
+		t.Fatalf("Expected the remote MOF directory to be created, commands were: %v", comm.Commands)
+	}
+}
+
+func pullServerConfig() map[string]interface{} {
+	config := testConfig()
+	delete(config, "manifest_file")
+	delete(config, "configuration_file")
+	delete(config, "configuration_params")
+	config["pull_server_url"] = "https://pull.example.com:8080/PSDSCPullServer.svc"
+	config["registration_key"] = "c1a2c4d6-0000-4a4b-9c9d-123456789abc"
+	config["configuration_names"] = []string{"WebServer", "Monitoring"}
+	return config
+}
 
-	bytes, err := ioutil.ReadFile(command)
+func TestProvisionerPrepare_pullServer(t *testing.T) {
+	config := pullServerConfig()
+	p := new(Provisioner)
+	err := p.Prepare(config)
 	if err != nil {
-		t.Fatalf(err.Error())
+		t.Fatalf("err: %s", err)
 	}
-	scriptContents := strings.TrimSpace(string(bytes))
-
-	expectedCommand := `
-#
-# DSC Runner.
-#
-# Bootstraps the DSC environment, sets up configuration data
-# and runs the DSC Configuration.
-#
-#
-# Set the local PowerShell Module environment path
 
-$absoluteModulePaths = [string]::Join(";", ("/tmp/packer-dsc-pull/module-0".Split(";") | ForEach-Object { $_ | Resolve-Path }))
-echo "Adding to path: $absoluteModulePaths"
-$env:PSModulePath="$absoluteModulePaths;${env:PSModulePath}"
-("/tmp/packer-dsc-pull/module-0".Split(";") | ForEach-Object { gci -Recurse  $_ | ForEach-Object { Unblock-File  $_.FullName} })
+	// Mutually exclusive with applying a Configuration
+	config["manifest_file"] = testConfig()["manifest_file"]
+	p = new(Provisioner)
+	err = p.Prepare(config)
+	if err == nil || !strings.Contains(err.Error(), "Conflicting settings: manifest_file, pull_server_url.") {
+		t.Fatalf("Expected manifest_file conflict but got: %v", err)
+	}
 
+	// Registration key is required
+	config = pullServerConfig()
+	delete(config, "registration_key")
+	p = new(Provisioner)
+	err = p.Prepare(config)
+	if err == nil {
+		t.Fatal("should have error")
+	}
 
-$script = $("/tmp/packer-dsc-pull/manifest/packer-dsc-pull-manifest" | Resolve-Path)
-echo "PSModulePath Configured: ${env:PSModulePath}"
-echo "Running Configuration file: ${script}"
+	// URL must be valid
+	config = pullServerConfig()
+	config["pull_server_url"] = "pull.example.com"
+	p = new(Provisioner)
+	err = p.Prepare(config)
+	if err == nil {
+		t.Fatal("should have error")
+	}
+}
 
+func TestProvisionerProvision_pullServer(t *testing.T) {
+	config := pullServerConfig()
+	config["pull_server_url"] = "http://pull.example.com:8080/PSDSCPullServer.svc"
+	ui := &packer.MachineReadableUi{
+		Writer: ioutil.Discard,
+	}
+	comm := new(testCommunicator)
 
-# Generate the MOF file, only if a MOF path not already provided.
-# Import the Manifest
-. $script
+	p := new(Provisioner)
+	err := p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
 
-cd "/tmp/packer-dsc-pull"
-$StagingPath = $(Join-Path "/tmp/packer-dsc-pull" "staging")
+	err = p.Provision(ui, comm)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
 
-SomeProjectName -OutputPath $StagingPath -Website "Beanstalk"
+	if comm.ran("packer-dsc-runner") {
+		t.Fatal("Expected no Configuration to be applied in pull mode")
+	}
 
+	expected := []string{
+		`RefreshMode = "Pull"`,
+		`ServerURL = 'http://pull.example.com:8080/PSDSCPullServer.svc'`,
+		`RegistrationKey = 'c1a2c4d6-0000-4a4b-9c9d-123456789abc'`,
+		`ConfigurationNames = @('WebServer', 'Monitoring')`,
+		`AllowUnsecureConnection = $true`,
+	}
+	for _, e := range expected {
+		if !strings.Contains(comm.UploadData, e) {
+			t.Fatalf("Expected LCM script to contain '%s' but got:\n\n%s", e, comm.UploadData)
+		}
+	}
+}
 
-# Start a DSC Configuration run
-Start-DscConfiguration -Force -Wait -Verbose -Path $StagingPath`
+func partialConfigurationsConfig(t *testing.T) map[string]interface{} {
+	dir, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("error tempdir: %s", err)
+	}
+	base := filepath.Join(dir, "Base.mof")
+	if err := ioutil.WriteFile(base, []byte("instance of MSFT_Configuration {};"), 0644); err != nil {
+		t.Fatalf("error writing MOF: %s", err)
+	}
 
-	if scriptContents != strings.TrimSpace(expectedCommand) {
-		t.Fatalf("Expected:\n\n%s\n\nbut got: \n\n%s", strings.TrimSpace(expectedCommand), scriptContents)
+	config := pullServerConfig()
+	delete(config, "pull_server_url")
+	config["partial_configurations"] = []map[string]interface{}{
+		{"name": "Base", "mof_path": base},
+		{"name": "WebServer", "mof_path": dir, "depends_on": []string{"Base"}},
 	}
+	return config
 }
 
-func TestProvisioner_removeDir(t *testing.T) {
-	config := testConfig()
+func TestProvisionerPrepare_partialConfigurations(t *testing.T) {
+	config := partialConfigurationsConfig(t)
 	p := new(Provisioner)
-	err := p.Prepare(config)
-	if err != nil {
+	if err := p.Prepare(config); err != nil {
 		t.Fatalf("err: %s", err)
 	}
-	ui := &packer.MachineReadableUi{
-		Writer: ioutil.Discard,
-	}
-	comm := new(packer.MockCommunicator)
-	err = p.removeDir(ui, comm, "somedir")
-	if err != nil {
-		t.Fatalf("err: %s", err)
+	if len(p.config.PartialConfigurations) != 2 || p.config.PartialConfigurations[1].DependsOn[0] != "Base" {
+		t.Fatalf("Unexpected partial_configurations: %#v", p.config.PartialConfigurations)
 	}
 
-	comm.StartExitStatus = 1
-	err = p.removeDir(ui, comm, "somedir")
-	if err == nil {
-		t.Fatalf("Expected error but got none")
+	cases := []struct {
+		name     string
+		partials []map[string]interface{}
+		expected string
+	}{
+		{
+			name:     "invalid name",
+			partials: []map[string]interface{}{{"name": "Web Server", "mof_path": "."}},
+			expected: "partial_configurations[0] name is invalid: 'Web Server'",
+		},
+		{
+			name:     "duplicate name",
+			partials: []map[string]interface{}{{"name": "Base", "mof_path": "."}, {"name": "Base", "mof_path": "."}},
+			expected: "partial_configurations[1] name 'Base' is already used",
+		},
+		{
+			name:     "missing MOF",
+			partials: []map[string]interface{}{{"name": "Base", "mof_path": "i/do/not/exist.mof"}},
+			expected: "partial_configurations[0] mof_path is invalid",
+		},
+		{
+			name: "dependency listed later",
+			partials: []map[string]interface{}{
+				{"name": "WebServer", "mof_path": ".", "depends_on": []string{"Base"}},
+				{"name": "Base", "mof_path": "."},
+			},
+			expected: "partial_configurations[0] depends on 'Base', which must be listed before it",
+		},
+	}
+	for _, tc := range cases {
+		config := partialConfigurationsConfig(t)
+		config["partial_configurations"] = tc.partials
+		p := new(Provisioner)
+		err := p.Prepare(config)
+		if err == nil || !strings.Contains(err.Error(), tc.expected) {
+			t.Fatalf("%s: expected '%s' but got: %v", tc.name, tc.expected, err)
+		}
 	}
 
+	// Mutually exclusive with applying a single Configuration
+	config = partialConfigurationsConfig(t)
+	config["manifest_file"] = testConfig()["manifest_file"]
+	p = new(Provisioner)
+	err := p.Prepare(config)
+	if err == nil || !strings.Contains(err.Error(), "Conflicting settings: manifest_file, partial_configurations.") {
+		t.Fatalf("Expected manifest_file conflict but got: %v", err)
+	}
+
+	config = partialConfigurationsConfig(t)
+	config["local_configuration_manager"] = map[string]string{"RefreshMode": "Pull"}
+	p = new(Provisioner)
+	if err := p.Prepare(config); err == nil {
+		t.Fatal("should have error")
+	}
+}
+
+func TestProvisionerProvision_partialConfigurations(t *testing.T) {
+	config := partialConfigurationsConfig(t)
+	ui := &packer.MachineReadableUi{
+		Writer: ioutil.Discard,
+	}
+	comm := new(testCommunicator)
+
+	p := new(Provisioner)
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := p.Provision(ui, comm); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	var lcm string
+	for path, data := range comm.uploads {
+		if strings.Contains(path, "packer-dsc-lcm") {
+			lcm = string(data)
+		}
+	}
+	expectedLCM := []string{
+		"PartialConfiguration Base\n\t\t{\n\t\t\tRefreshMode = \"Push\"\n\t\t}",
+		"PartialConfiguration WebServer",
+		"DependsOn = @('[PartialConfiguration]Base')",
+	}
+	for _, e := range expectedLCM {
+		if !strings.Contains(lcm, e) {
+			t.Fatalf("Expected LCM script to contain '%s' but got:\n\n%s", e, lcm)
+		}
+	}
+
+	if _, ok := comm.uploads["/tmp/packer-dsc-pull/partials/Base/localhost.mof"]; !ok {
+		t.Fatalf("Expected the Base MOF to be uploaded as localhost.mof, uploads were: %v", comm.uploads)
+	}
+
+	runner := runnerScript(t, comm)
+	expected := []string{
+		`("/tmp/packer-dsc-pull/partials/Base;/tmp/packer-dsc-pull/partials/WebServer".Split(";") | ForEach-Object { Publish-DscConfiguration -Force -Verbose -Path $_ })`,
+		"Start-DscConfiguration -Force -Wait -Verbose -UseExisting",
+	}
+	for _, e := range expected {
+		if !strings.Contains(runner, e) {
+			t.Fatalf("Expected runner to contain '%s' but got:\n\n%s", e, runner)
+		}
+	}
+	if strings.Contains(runner, "-Path $StagingPath") {
+		t.Fatalf("Expected no single Configuration to be applied but got:\n\n%s", runner)
+	}
+}
+
+func TestProvisionerProvision_noConfigurationParams(t *testing.T) {
+	config := testConfig()
+	ui := &packer.MachineReadableUi{
+		Writer: ioutil.Discard,
+	}
+	comm := new(testCommunicator)
+	config["configuration_name"] = "SomeProjectName"
+	config["module_paths"] = []string{"."}
+	delete(config, "configuration_file")
+	delete(config, "configuration_params")
+
+	// Test with valid values
+	p := new(Provisioner)
+	err := p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	err = p.Provision(ui, comm)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	scriptContents := runnerScript(t, comm)
+
+	expectedCommand := `
+$env:PACKER_BUILDER_TYPE = ''
+$env:PACKER_BUILD_NAME = ''
+
+#
+# DSC Runner.
+#
+# Bootstraps the DSC environment, sets up configuration data
+# and runs the DSC Configuration.
+#
+#
+# Run from the working directory, so relative paths resolve against it
+cd "/tmp/packer-dsc-pull"
+
+# Set the local PowerShell Module environment path
+
+$absoluteModulePaths = [string]::Join(";", ("/tmp/packer-dsc-pull/module-0".Split(";") | ForEach-Object { $_ | Resolve-Path }))
+echo "Adding to path: $absoluteModulePaths"
+$env:PSModulePath="$absoluteModulePaths;${env:PSModulePath}"
+("/tmp/packer-dsc-pull/module-0".Split(";") | ForEach-Object { gci -Recurse  $_ | ForEach-Object { Unblock-File  $_.FullName} })
+
+
+echo "PSModulePath Configured: ${env:PSModulePath}"
+
+
+# Generate the MOF file, only if a MOF path not already provided.
+# Import the Manifest
+$script = $("/tmp/packer-dsc-pull/manifest/packer-dsc-pull-manifest" | Resolve-Path)
+echo "Running Configuration file: ${script}"
+. $script
+
+$StagingPath = $(Join-Path "/tmp/packer-dsc-pull" "staging")
+
+SomeProjectName -OutputPath $StagingPath 
+
+
+# Start a DSC Configuration run
+Start-DscConfiguration -Force -Wait -Verbose -Path $StagingPath`
+
+	if scriptContents != strings.TrimSpace(expectedCommand) {
+		t.Fatalf("Expected:\n\n%s\n\nbut got: \n\n%s", strings.TrimSpace(expectedCommand), scriptContents)
+	}
+}
+
+func TestProvisionerProvision_configurationParams(t *testing.T) {
+	config := testConfig()
+	ui := &packer.MachineReadableUi{
+		Writer: ioutil.Discard,
+	}
+	comm := new(testCommunicator)
+	configurationParams := map[string]string{
+		"-Website": "Beanstalk",
+	}
+	config["configuration_name"] = "SomeProjectName"
+	delete(config, "configuration_file")
+	config["configuration_params"] = configurationParams
+	config["module_paths"] = []string{"."}
+
+	// Test with valid values
+	p := new(Provisioner)
+	err := p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	err = p.Provision(ui, comm)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	scriptContents := runnerScript(t, comm)
+
+	expectedCommand := `
+$env:PACKER_BUILDER_TYPE = ''
+$env:PACKER_BUILD_NAME = ''
+
+#
+# DSC Runner.
+#
+# Bootstraps the DSC environment, sets up configuration data
+# and runs the DSC Configuration.
+#
+#
+# Run from the working directory, so relative paths resolve against it
+cd "/tmp/packer-dsc-pull"
+
+# Set the local PowerShell Module environment path
+
+$absoluteModulePaths = [string]::Join(";", ("/tmp/packer-dsc-pull/module-0".Split(";") | ForEach-Object { $_ | Resolve-Path }))
+echo "Adding to path: $absoluteModulePaths"
+$env:PSModulePath="$absoluteModulePaths;${env:PSModulePath}"
+("/tmp/packer-dsc-pull/module-0".Split(";") | ForEach-Object { gci -Recurse  $_ | ForEach-Object { Unblock-File  $_.FullName} })
+
+
+echo "PSModulePath Configured: ${env:PSModulePath}"
+
+
+# Generate the MOF file, only if a MOF path not already provided.
+# Import the Manifest
+$script = $("/tmp/packer-dsc-pull/manifest/packer-dsc-pull-manifest" | Resolve-Path)
+echo "Running Configuration file: ${script}"
+. $script
+
+$StagingPath = $(Join-Path "/tmp/packer-dsc-pull" "staging")
+
+SomeProjectName -OutputPath $StagingPath -Website 'Beanstalk'
+
+
+# Start a DSC Configuration run
+Start-DscConfiguration -Force -Wait -Verbose -Path $StagingPath`
+
+	if scriptContents != strings.TrimSpace(expectedCommand) {
+		t.Fatalf("Expected:\n\n%s\n\nbut got: \n\n%s", strings.TrimSpace(expectedCommand), scriptContents)
+	}
+}
+
+func TestProvisioner_removeDir(t *testing.T) {
+	config := testConfig()
+	p := new(Provisioner)
+	err := p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	ui := &packer.MachineReadableUi{
+		Writer: ioutil.Discard,
+	}
+	comm := new(packer.MockCommunicator)
+	err = p.removeDir(context.Background(), ui, comm, "somedir")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// A path which is already gone isn't an error
+	if !strings.Contains(comm.StartCmd.Command, "if (Test-Path 'somedir') { Remove-Item 'somedir' -Recurse -Force }") {
+		t.Fatalf("Expected the path to be checked before it is removed but got: %s", comm.StartCmd.Command)
+	}
+
+	comm.StartExitStatus = 1
+	err = p.removeDir(context.Background(), ui, comm, "somedir")
+	if err == nil {
+		t.Fatalf("Expected error but got none")
+	}
+
+}
+
+func TestProvisionerPrepare_localConfigurationManager(t *testing.T) {
+	config := testConfig()
+
+	// Unsupported setting
+	config["local_configuration_manager"] = map[string]string{
+		"RefreshFrequencyMins": "30",
+	}
+	p := new(Provisioner)
+	err := p.Prepare(config)
+	if err == nil {
+		t.Fatal("should be an error")
+	}
+
+	// Invalid value for a supported setting
+	config["local_configuration_manager"] = map[string]string{
+		"ConfigurationMode": "ApplyAndForget",
+	}
+	p = new(Provisioner)
+	err = p.Prepare(config)
+	if err == nil {
+		t.Fatal("should be an error")
+	}
+
+	// Test with a good one
+	config["local_configuration_manager"] = map[string]string{
+		"ConfigurationMode":  "applyandautocorrect",
+		"RebootNodeIfNeeded": "true",
+		"ActionAfterReboot":  "ContinueConfiguration",
+		"RefreshMode":        "Push",
+	}
+	p = new(Provisioner)
+	err = p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if p.config.LocalConfigurationManager["ConfigurationMode"] != "ApplyAndAutoCorrect" {
+		t.Fatalf("Expected ConfigurationMode to be normalised but got '%s'", p.config.LocalConfigurationManager["ConfigurationMode"])
+	}
+}
+
+func TestProvisioner_configureLCM(t *testing.T) {
+	config := testConfig()
+	config["local_configuration_manager"] = map[string]string{
+		"ConfigurationMode":  "ApplyAndAutoCorrect",
+		"RebootNodeIfNeeded": "true",
+	}
+	p := new(Provisioner)
+	err := p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	ui := &packer.MachineReadableUi{
+		Writer: ioutil.Discard,
+	}
+	comm := new(testCommunicator)
+	err = p.configureLCM(context.Background(), ui, comm)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected := []string{
+		`ConfigurationMode = "ApplyAndAutoCorrect"`,
+		`RebootNodeIfNeeded = $true`,
+		`Set-DscLocalConfigurationManager -Path "/tmp/packer-dsc-pull/lcm"`,
+	}
+	for _, e := range expected {
+		if !strings.Contains(comm.UploadData, e) {
+			t.Fatalf("Expected LCM script to contain '%s' but got:\n\n%s", e, comm.UploadData)
+		}
+	}
+
+	comm = &testCommunicator{
+		ExitStatuses: map[string]int{"packer-dsc-lcm": 1},
+	}
+	err = p.configureLCM(context.Background(), ui, comm)
+	if err == nil {
+		t.Fatalf("Expected error but got none")
+	}
+}
+
+func TestProvisionerProvision_rebootNodeIfNeeded(t *testing.T) {
+	config := testConfig()
+	config["reboot_node_if_needed"] = true
+	ui := &packer.MachineReadableUi{
+		Writer: ioutil.Discard,
+	}
+	comm := &testCommunicator{
+		Stdout: map[string]string{"LCMState": "Idle\n"},
+	}
+
+	p := new(Provisioner)
+	err := p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	err = p.Provision(ui, comm)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if !comm.ran(p.powershellCommand(lcmStateScript)) {
+		t.Fatalf("Expected the LCM state to be checked, but commands were: %v", comm.Commands)
+	}
+}
+
+func TestProvisionerProvision_rebootAndResume(t *testing.T) {
+	config := testConfig()
+	config["reboot_node_if_needed"] = true
+	ui := &packer.MachineReadableUi{
+		Writer: ioutil.Discard,
+	}
+	comm := &testCommunicator{
+		StdoutSequence: map[string][]string{
+			"LCMState":       {"PendingReboot\n", "PendingConfiguration\n", "Idle\n"},
+			"LastBootUpTime": {"20260101000000\n", "20260101000500\n"},
+		},
+	}
+
+	p := new(Provisioner)
+	err := p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	err = p.Provision(ui, comm)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	for _, command := range []string{restartCommand, resumeScript, verifyScript} {
+		if !comm.ran(command) {
+			t.Fatalf("Expected '%s' to be run, but commands were: %v", command, comm.Commands)
+		}
+	}
+	if p.summary.Reboots != 1 {
+		t.Fatalf("Expected 1 reboot but got %d", p.summary.Reboots)
+	}
+}
+
+func TestProvisionerProvision_rebootStartError(t *testing.T) {
+	config := testConfig()
+	config["reboot_node_if_needed"] = true
+	ui := &packer.MachineReadableUi{
+		Writer: ioutil.Discard,
+	}
+	comm := &testCommunicator{
+		Stdout:    map[string]string{"LCMState": "Idle\n"},
+		FailStart: "& { /tmp/packer-dsc-runner",
+	}
+
+	p := new(Provisioner)
+	err := p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// A runner that never started isn't taken for a restart
+	err = p.Provision(ui, comm)
+	if err == nil || !strings.Contains(err.Error(), "Error starting remote command") {
+		t.Fatalf("Expected start error but got: %v", err)
+	}
+	if comm.ran(verifyScript) {
+		t.Fatalf("Expected the Configuration not to be verified, but commands were: %v", comm.Commands)
+	}
+}
+
+func TestProvisionerProvision_rebootNeverCompletes(t *testing.T) {
+	config := testConfig()
+	config["reboot_node_if_needed"] = true
+	config["start_retry_timeout"] = "10ms"
+	ui := &packer.MachineReadableUi{
+		Writer: ioutil.Discard,
+	}
+	comm := &testCommunicator{
+		Stdout: map[string]string{"LCMState": "PendingReboot\n"},
+	}
+
+	retryableSleep = 1 * time.Millisecond
+	defer func() { retryableSleep = 2 * time.Second }()
+
+	p := new(Provisioner)
+	err := p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if p.config.StartRetryTimeout != 10*time.Millisecond {
+		t.Fatalf("Expected start_retry_timeout to be 10ms but got %s", p.config.StartRetryTimeout)
+	}
+
+	err = p.Provision(ui, comm)
+	if err == nil || !strings.Contains(err.Error(), "Machine has not restarted yet") {
+		t.Fatalf("Expected restart error but got: %v", err)
+	}
+}
+
+// testCommunicator is a MockCommunicator that records every command
+// started, exiting with the status configured for the first matching
+// pattern in ExitStatuses. Commands matching Hang never exit, and those
+// matching FailStart fail to start. Commands matching a pattern in
+// StdoutSequence write each of its outputs in turn, repeating the last.
+//
+// Files uploaded are kept so that Get-FileHash reports their hash,
+// with the first CorruptUploads uploads corrupted. Chunks of a chunked
+// upload are appended as the remote host would, with the first
+// FailAppends appends failing once the chunk has been appended.
+type testCommunicator struct {
+	packer.MockCommunicator
+	Commands       []string
+	ExitStatuses   map[string]int
+	Stdout         map[string]string
+	StdoutSequence map[string][]string
+	Hang           string
+	FailStart      string
+	CorruptUploads int
+	FailAppends    int
+
+	uploads map[string][]byte
+}
+
+var fileHashRegexp = regexp.MustCompile(`Get-FileHash -Algorithm SHA256 -Path '([^']+)'`)
+
+var appendChunkRegexp = regexp.MustCompile(`ReadAllBytes\('([^']+)'\); \$f = \[IO.File\]::Open\('([^']+)', 'OpenOrCreate'\); \$f.SetLength\(([0-9]+)\)`)
+
+func (c *testCommunicator) Upload(path string, r io.Reader, fi *os.FileInfo) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if c.CorruptUploads > 0 {
+		c.CorruptUploads--
+		data = []byte("corrupt")
+	}
+
+	if c.uploads == nil {
+		c.uploads = make(map[string][]byte)
+	}
+	c.uploads[path] = data
+
+	return c.MockCommunicator.Upload(path, bytes.NewReader(data), fi)
+}
+
+func (c *testCommunicator) Start(rc *packer.RemoteCmd) error {
+	if m := fileHashRegexp.FindStringSubmatch(rc.Command); m != nil {
+		sum := sha256.Sum256(c.uploads[m[1]])
+		go func() {
+			rc.Stdout.Write([]byte(strings.ToUpper(hex.EncodeToString(sum[:])) + "\r\n"))
+			rc.SetExited(0)
+		}()
+		return nil
+	}
+
+	if m := appendChunkRegexp.FindStringSubmatch(rc.Command); m != nil {
+		offset, _ := strconv.Atoi(m[3])
+		data := c.uploads[m[2]]
+		if len(data) > offset {
+			data = data[:offset]
+		}
+		c.uploads[m[2]] = append(data, c.uploads[m[1]]...)
+		delete(c.uploads, m[1])
+
+		if c.FailAppends > 0 {
+			c.FailAppends--
+			c.Commands = append(c.Commands, rc.Command)
+			go rc.SetExited(1)
+			return nil
+		}
+	}
+
+	if c.FailStart != "" && strings.Contains(rc.Command, c.FailStart) {
+		return errors.New("http response error: 401 - invalid content type")
+	}
+
+	c.StartCalled = true
+	c.StartCmd = rc
+	c.Commands = append(c.Commands, rc.Command)
+
+	status := 0
+	for pattern, s := range c.ExitStatuses {
+		if strings.Contains(rc.Command, pattern) {
+			status = s
+			break
+		}
+	}
+
+	stdout := ""
+	for pattern, out := range c.Stdout {
+		if strings.Contains(rc.Command, pattern) {
+			stdout = out
+			break
+		}
+	}
+	for pattern, outs := range c.StdoutSequence {
+		if strings.Contains(rc.Command, pattern) {
+			stdout = outs[0]
+			if len(outs) > 1 {
+				c.StdoutSequence[pattern] = outs[1:]
+			}
+			break
+		}
+	}
+
+	if c.Hang != "" && strings.Contains(rc.Command, c.Hang) {
+		return nil
+	}
+
+	go func() {
+		if rc.Stdout != nil && stdout != "" {
+			rc.Stdout.Write([]byte(stdout))
+		}
+		rc.SetExited(status)
+	}()
+	return nil
+}
+
+// ran returns true if a command containing pattern was started
+func (c *testCommunicator) ran(pattern string) bool {
+	for _, command := range c.Commands {
+		if strings.Contains(command, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// runnerScript returns the contents of the DSC runner script that was
+// run on the communicator.
+func runnerScript(t *testing.T, comm *testCommunicator) string {
+	re := regexp.MustCompile(`powershell -ExecutionPolicy Bypass -Command \"\& \{ ([a-zA-Z0-9-\/]+packer-dsc-runner-[0-9a-f-]+\.ps1).*`)
+	for _, command := range comm.Commands {
+		if m := re.FindStringSubmatch(command); m != nil {
+			return strings.TrimSpace(strings.Replace(string(comm.uploads[m[1]]), "\r\n", "\n", -1))
+		}
+	}
+
+	t.Fatalf("DSC runner was not run, commands were: %v", comm.Commands)
+	return ""
+}
+
+func TestProvisionerProvision_installPackageManagementFail(t *testing.T) {
+	config := testConfig()
+	config["install_package_management"] = true
+	ui := &packer.MachineReadableUi{
+		Writer: ioutil.Discard,
+	}
+	comm := &testCommunicator{
+		ExitStatuses: map[string]int{"packer-dsc-packagemanagement": 3},
+	}
+
+	p := new(Provisioner)
+	err := p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	err = p.Provision(ui, comm)
+	if err == nil {
+		t.Fatalf("Expected error but got none")
+	}
+	if !strings.Contains(err.Error(), "non-zero exit status: 3") {
+		t.Fatalf("Expected a non-zero exit status error but got: %s", err)
+	}
+}
+
+func TestProvisionerPrepare_environmentVars(t *testing.T) {
+	config := testConfig()
+
+	// Test with a bad case
+	config["environment_vars"] = []string{"badvar", "good=var"}
+	p := new(Provisioner)
+	err := p.Prepare(config)
+	if err == nil {
+		t.Fatal("should have error")
+	}
+
+	// Test with a trickier case
+	config["environment_vars"] = []string{"=bad"}
+	p = new(Provisioner)
+	err = p.Prepare(config)
+	if err == nil {
+		t.Fatal("should have error")
+	}
+
+	// Names must be valid in $env:NAME
+	for _, name := range []string{"MY-VAR", "a.b", "ProgramFiles(x86)", "1FOO"} {
+		config["environment_vars"] = []string{name + "=bar"}
+		p = new(Provisioner)
+		err = p.Prepare(config)
+		if err == nil || !strings.Contains(err.Error(), "Environment variable name is invalid") {
+			t.Fatalf("Expected %s to be rejected but got: %v", name, err)
+		}
+	}
+
+	// Test with a good case
+	config["environment_vars"] = []string{"FOO=bar", "BAZ=qux=quux", "_MY_VAR2=x"}
+	p = new(Provisioner)
+	err = p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Build values are available to the template functions
+	config["environment_vars"] = []string{"IMAGE={{build_name}}-{{build_type}}"}
+	config["packer_build_name"] = "web"
+	config["packer_builder_type"] = "hyperv-iso"
+	p = new(Provisioner)
+	err = p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if p.config.Vars[0] != "IMAGE=web-hyperv-iso" {
+		t.Fatalf("Expected build values to be interpolated but got: %s", p.config.Vars[0])
+	}
+}
+
+func TestProvisionerPrepare_environmentVarsFile(t *testing.T) {
+	config := testConfig()
+	tf, err := ioutil.TempFile("", "packer")
+	if err != nil {
+		t.Fatalf("error tempfile: %s", err)
+	}
+	defer os.Remove(tf.Name())
+
+	tf.WriteString("# Secrets\r\nTOKEN=secret\r\n\nFOO=from-file\n")
+	tf.Close()
+
+	config["environment_vars_file"] = tf.Name()
+	config["environment_vars"] = []string{"FOO=bar"}
+	p := new(Provisioner)
+	err = p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected := []string{"TOKEN=secret", "FOO=from-file", "FOO=bar"}
+	if strings.Join(p.config.Vars, ",") != strings.Join(expected, ",") {
+		t.Fatalf("Expected vars %v but got %v", expected, p.config.Vars)
+	}
+
+	// environment_vars take precedence over the file
+	flattened := p.createFlattenedEnvVars()
+	if !strings.Contains(flattened, "$env:FOO = 'bar'\n") || !strings.Contains(flattened, "$env:TOKEN = 'secret'\n") {
+		t.Fatalf("Unexpected environment variables:\n\n%s", flattened)
+	}
+
+	// Lines are validated like environment_vars
+	tf, err = ioutil.TempFile("", "packer")
+	if err != nil {
+		t.Fatalf("error tempfile: %s", err)
+	}
+	defer os.Remove(tf.Name())
+	tf.WriteString("=bad\n")
+	tf.Close()
+
+	config["environment_vars_file"] = tf.Name()
+	p = new(Provisioner)
+	err = p.Prepare(config)
+	if err == nil {
+		t.Fatal("should have error")
+	}
+
+	config["environment_vars_file"] = "/i/dont/exist"
+	p = new(Provisioner)
+	err = p.Prepare(config)
+	if err == nil {
+		t.Fatal("should have error")
+	}
+}
+
+func TestProvisioner_createDscScriptEnvironmentVars(t *testing.T) {
+	config := testConfig()
+	config["packer_build_name"] = "vagrant"
+	config["packer_builder_type"] = "virtualbox-ovf"
+	config["environment_vars"] = []string{"FOO=it's"}
+	p := new(Provisioner)
+	err := p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	tmpl := ExecuteTemplate{ConfigurationName: "SomeProjectName"}
+	p.config.ctx.Data = &tmpl
+	runner, err := p.createDscScript(tmpl)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected := "$env:FOO = 'it''s'\n$env:PACKER_BUILDER_TYPE = 'virtualbox-ovf'\n$env:PACKER_BUILD_NAME = 'vagrant'\n"
+	if !strings.HasPrefix(runner, expected) {
+		t.Fatalf("Expected runner to start with:\n\n%s\n\nbut got: \n\n%s", expected, runner)
+	}
+}
+
+func TestProvisionerProvision_runnerNotWrittenLocally(t *testing.T) {
+	config := testConfig()
+	config["environment_vars"] = []string{"PASSWORD=secret"}
+	ui := &packer.MachineReadableUi{
+		Writer: ioutil.Discard,
+	}
+	comm := new(testCommunicator)
+
+	p := new(Provisioner)
+	err := p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	before, _ := filepath.Glob("/tmp/packer-dsc-runner*")
+	err = p.Provision(ui, comm)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	after, _ := filepath.Glob("/tmp/packer-dsc-runner*")
+
+	// The runner holds environment_vars, so is uploaded without a local copy
+	if len(after) != len(before) {
+		t.Fatalf("Expected no local runner to be written but found: %v", after)
+	}
+	if runner := runnerScript(t, comm); !strings.Contains(runner, "$env:PASSWORD = 'secret'") {
+		t.Fatalf("Expected the runner to be uploaded but got:\n\n%s", runner)
+	}
+}
+
+func TestProvisioner_createDscScriptSkipPackerVars(t *testing.T) {
+	config := testConfig()
+	config["packer_build_name"] = "vagrant"
+	config["packer_builder_type"] = "virtualbox-ovf"
+	config["environment_vars"] = []string{"FOO=bar"}
+	config["skip_packer_vars"] = true
+	p := new(Provisioner)
+	err := p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	tmpl := ExecuteTemplate{ConfigurationName: "SomeProjectName"}
+	p.config.ctx.Data = &tmpl
+	runner, err := p.createDscScript(tmpl)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if !strings.HasPrefix(runner, "$env:FOO = 'bar'\n\n#") {
+		t.Fatalf("Expected only environment_vars to be set but got: \n\n%s", runner)
+	}
+	if strings.Contains(runner, "PACKER_") {
+		t.Fatalf("Expected Packer variables to be absent but got: \n\n%s", runner)
+	}
+}
+
+func TestProvisionerPrepare_configurationParamsUserVariables(t *testing.T) {
+	config := testConfig()
+	config["packer_user_variables"] = map[string]string{
+		"website": "Beanstalk",
+	}
+	config["configuration_params"] = map[string]string{
+		"-Website": "{{user `website`}}",
+	}
+
+	p := new(Provisioner)
+	err := p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if p.config.ConfigurationParams["-Website"] != "Beanstalk" {
+		t.Fatalf("Expected user variable to be interpolated but got '%s'", p.config.ConfigurationParams["-Website"])
+	}
+}
+
+func TestProvisionerPrepare_elevatedUser(t *testing.T) {
+	config := testConfig()
+
+	// Only a user
+	config["elevated_user"] = "vagrant"
+	p := new(Provisioner)
+	err := p.Prepare(config)
+	if err == nil {
+		t.Fatal("should have error")
+	}
+
+	// Only a password
+	delete(config, "elevated_user")
+	config["elevated_password"] = "vagrant"
+	p = new(Provisioner)
+	err = p.Prepare(config)
+	if err == nil {
+		t.Fatal("should have error")
+	}
+
+	// Test with a good one
+	config["elevated_user"] = "vagrant"
+	p = new(Provisioner)
+	err = p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestProvisionerProvision_elevatedUser(t *testing.T) {
+	config := testConfig()
+	config["elevated_user"] = "vagrant"
+	config["elevated_password"] = "vagrant"
+	config["report_status"] = false
+	ui := &packer.MachineReadableUi{
+		Writer: ioutil.Discard,
+	}
+	comm := new(testCommunicator)
+
+	p := new(Provisioner)
+	err := p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	err = p.Provision(ui, comm)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	re := regexp.MustCompile(`^powershell -ExecutionPolicy Bypass -File "/tmp/packer-dsc-elevated-[0-9a-f-]+\.ps1"$`)
+	if !re.MatchString(comm.StartCmd.Command) {
+		t.Fatalf("Expected elevated wrapper to be run but got '%s'", comm.StartCmd.Command)
+	}
+	if !strings.Contains(comm.UploadData, "<UserId>vagrant</UserId>") {
+		t.Fatalf("Expected elevated wrapper to run as the elevated user but got:\n\n%s", comm.UploadData)
+	}
+
+	// The wrapper holds the password, so it removes itself
+	if !strings.Contains(comm.UploadData, "Remove-Item -LiteralPath $MyInvocation.MyCommand.Path") {
+		t.Fatalf("Expected elevated wrapper to remove itself but got:\n\n%s", comm.UploadData)
+	}
+
+	// Values are passed literally
+	config["elevated_user"] = `R&D\vagrant`
+	config["elevated_password"] = "pa$s\"w`or'd"
+	p = new(Provisioner)
+	err = p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	comm = new(testCommunicator)
+	err = p.Provision(ui, comm)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !strings.Contains(comm.UploadData, `<UserId>R&amp;D\vagrant</UserId>`) {
+		t.Fatalf("Expected the user to be XML escaped but got:\n\n%s", comm.UploadData)
+	}
+	if !strings.Contains(comm.UploadData, `RegisterTaskDefinition($name, $t, 6, 'R&D\vagrant', 'pa$s"w`+"`"+`or''d', 1, $null)`) {
+		t.Fatalf("Expected the credentials to be single-quoted but got:\n\n%s", comm.UploadData)
+	}
+
+	// The wrapper is cleaned up if it never runs to remove itself
+	config["cleanup_on_failure"] = true
+	p = new(Provisioner)
+	err = p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	comm = &testCommunicator{
+		FailStart: `-File "/tmp/packer-dsc-elevated`,
+	}
+	err = p.Provision(ui, comm)
+	if err == nil {
+		t.Fatal("Expected error but got none")
+	}
+	re = regexp.MustCompile(`Remove-Item '/tmp/packer-dsc-elevated-[0-9a-f-]+\.ps1'`)
+	if !re.MatchString(strings.Join(comm.Commands, "\n")) {
+		t.Fatalf("Expected the elevated wrapper to be removed, but commands were: %v", comm.Commands)
+	}
+}
+
+func TestPowershellEncode(t *testing.T) {
+	// UTF-16LE base64 encoding of "dir"
+	if encoded := powershellEncode("dir"); encoded != "ZABpAHIA" {
+		t.Fatalf("Expected 'ZABpAHIA' but got '%s'", encoded)
+	}
+}
+
+func TestProvisionerPrepare_executionPolicy(t *testing.T) {
+	config := testConfig()
+
+	p := new(Provisioner)
+	err := p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if p.config.ExecutionPolicy != "Bypass" {
+		t.Fatalf("Expected default execution policy 'Bypass' but got '%s'", p.config.ExecutionPolicy)
+	}
+
+	config["execution_policy"] = "remotesigned"
+	p = new(Provisioner)
+	err = p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if command := p.powershellCommand("Get-Item"); command != `powershell -ExecutionPolicy RemoteSigned -Command "& { Get-Item; exit $LastExitCode}"` {
+		t.Fatalf("Unexpected command: %s", command)
+	}
+
+	config["execution_policy"] = "Whatever"
+	p = new(Provisioner)
+	err = p.Prepare(config)
+	if err == nil {
+		t.Fatal("should have error")
+	}
+}
+
+func TestProvisionerPrepare_showProgress(t *testing.T) {
+	config := testConfig()
+
+	p := new(Provisioner)
+	err := p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !p.config.ShowProgress {
+		t.Fatal("Expected show_progress to default to true")
+	}
+
+	config["show_progress"] = false
+	p = new(Provisioner)
+	err = p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if p.config.ShowProgress {
+		t.Fatal("Expected show_progress to be false")
+	}
+}
+
+func TestProvisionerProvision_manifestDir(t *testing.T) {
+	config := testConfig()
+	td, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	defer os.RemoveAll(td)
+
+	config["manifest_dir"] = td
+	delete(config, "resource_paths")
+	ui := &packer.MachineReadableUi{
+		Writer: ioutil.Discard,
+	}
+	comm := new(testCommunicator)
+
+	p := new(Provisioner)
+	err = p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	err = p.Provision(ui, comm)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if comm.UploadDirSrc != td+"/" {
+		t.Fatalf("Expected the contents of '%s' to be uploaded but got '%s'", td, comm.UploadDirSrc)
+	}
+	if comm.UploadDirDst != "/tmp/packer-dsc-pull/manifest" {
+		t.Fatalf("Expected manifest_dir to be uploaded to the staging dir but got '%s'", comm.UploadDirDst)
+	}
+}
+
+func TestProvisionerProvision_manifestFiles(t *testing.T) {
+	td, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	defer os.RemoveAll(td)
+
+	var manifests []string
+	for _, name := range []string{"Base", "WebServer"} {
+		path := filepath.Join(td, name+".ps1")
+		if err := ioutil.WriteFile(path, []byte("Configuration "+name+" {}"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		manifests = append(manifests, path)
+	}
+
+	config := testConfig()
+	delete(config, "manifest_file")
+	config["manifest_files"] = manifests
+	ui := &packer.MachineReadableUi{
+		Writer: ioutil.Discard,
+	}
+	comm := new(testCommunicator)
+
+	p := new(Provisioner)
+	err = p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	err = p.Provision(ui, comm)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Each is compiled into its own directory and applied in turn
+	re := regexp.MustCompile(`& \{ ([a-zA-Z0-9-\/]+packer-dsc-runner-[0-9a-f-]+\.ps1)`)
+	var runners []string
+	for _, command := range comm.Commands {
+		if m := re.FindStringSubmatch(command); m != nil {
+			runners = append(runners, strings.Replace(string(comm.uploads[m[1]]), "\r\n", "\n", -1))
+		}
+	}
+	if len(runners) != 2 {
+		t.Fatalf("Expected 2 runners but got %d, commands were: %v", len(runners), comm.Commands)
+	}
+	for i, name := range []string{"Base", "WebServer"} {
+		expected := []string{
+			`$script = $("/tmp/packer-dsc-pull/manifest/` + name + `.ps1" | Resolve-Path)`,
+			`$StagingPath = $(Join-Path "/tmp/packer-dsc-pull" "staging/` + name + `")`,
+			name + " -OutputPath $StagingPath",
+		}
+		for _, e := range expected {
+			if !strings.Contains(runners[i], e) {
+				t.Fatalf("Expected runner %d to contain '%s' but got:\n\n%s", i, e, runners[i])
+			}
+		}
+	}
+
+	// Stops at the first to fail
+	comm = &testCommunicator{
+		ExitStatuses: map[string]int{"packer-dsc-runner": 1},
+	}
+	err = p.Provision(ui, comm)
+	if err == nil || !strings.Contains(err.Error(), "Error applying Base") {
+		t.Fatalf("Expected Base to fail but got: %v", err)
+	}
+	if _, ok := comm.uploads["/tmp/packer-dsc-pull/manifest/WebServer.ps1"]; ok {
+		t.Fatal("Expected WebServer not to be applied")
+	}
+
+	// Including when DSC reports failed resources without exiting non-zero
+	comm = &testCommunicator{
+		ExitStatuses: map[string]int{"packer-dsc-status": 1},
+	}
+	err = p.Provision(ui, comm)
+	if err == nil || !strings.Contains(err.Error(), "Error applying Base: Error reporting DSC status") {
+		t.Fatalf("Expected the status of Base to fail but got: %v", err)
+	}
+	if _, ok := comm.uploads["/tmp/packer-dsc-pull/manifest/WebServer.ps1"]; ok {
+		t.Fatal("Expected WebServer not to be applied")
+	}
+
+	// Names must be unique
+	config["manifest_files"] = []string{manifests[0], manifests[0]}
+	p = new(Provisioner)
+	err = p.Prepare(config)
+	if err == nil || !strings.Contains(err.Error(), "manifest_files[1] has the same Configuration name as an earlier file: Base") {
+		t.Fatalf("Expected duplicate name error but got: %v", err)
+	}
+
+	config["manifest_files"] = manifests
+	config["configuration_name"] = "Base"
+	p = new(Provisioner)
+	err = p.Prepare(config)
+	if err == nil || !strings.Contains(err.Error(), "configuration_name cannot be used with manifest_files") {
+		t.Fatalf("Expected configuration_name error but got: %v", err)
+	}
+}
+
+func TestProvisionerProvision_scriptDir(t *testing.T) {
+	config := testConfig()
+	td, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	defer os.RemoveAll(td)
+
+	os.MkdirAll(filepath.Join(td, "partials"), 0755)
+	ioutil.WriteFile(filepath.Join(td, "Helpers.ps1"), []byte("function Get-Helper {}"), 0644)
+	ioutil.WriteFile(filepath.Join(td, "partials", "WebServer.ps1"), []byte("Configuration WebServer {}"), 0644)
+	ioutil.WriteFile(filepath.Join(td, "README.md"), []byte("Not a script"), 0644)
+
+	config["script_dir"] = td
+	ui := &packer.MachineReadableUi{
+		Writer: ioutil.Discard,
+	}
+	comm := new(testCommunicator)
+
+	p := new(Provisioner)
+	err = p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	err = p.Provision(ui, comm)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if string(comm.uploads["/tmp/packer-dsc-pull/scripts/Helpers.ps1"]) != "function Get-Helper {}" {
+		t.Fatalf("Expected Helpers.ps1 to be uploaded, uploads were: %v", comm.uploads)
+	}
+	if string(comm.uploads["/tmp/packer-dsc-pull/scripts/partials/WebServer.ps1"]) != "Configuration WebServer {}" {
+		t.Fatalf("Expected partials/WebServer.ps1 to be uploaded, uploads were: %v", comm.uploads)
+	}
+	if _, ok := comm.uploads["/tmp/packer-dsc-pull/scripts/README.md"]; ok {
+		t.Fatal("Expected only .ps1 files to be uploaded")
+	}
+	if !comm.ran("/tmp/packer-dsc-pull/scripts/partials") {
+		t.Fatalf("Expected the remote script directories to be created, commands were: %v", comm.Commands)
+	}
+
+	expected := `foreach ($s in (Get-ChildItem -Recurse -Filter *.ps1 "/tmp/packer-dsc-pull/scripts" | Sort-Object FullName)) { . $s.FullName }
+# Import the Manifest`
+	if !strings.Contains(runnerScript(t, comm), expected) {
+		t.Fatalf("Expected the scripts to be dot-sourced before the manifest, runner was:\n%s", runnerScript(t, comm))
+	}
+
+	// Must be a directory
+	config["script_dir"] = "./provisioner_test.go"
+	p = new(Provisioner)
+	err = p.Prepare(config)
+	if err == nil {
+		t.Fatal("should have error")
+	}
+}
+
+func TestProvisionerProvision_reportStatus(t *testing.T) {
+	config := testConfig()
+	ui := &packer.MachineReadableUi{
+		Writer: ioutil.Discard,
+	}
+	comm := new(testCommunicator)
+
+	p := new(Provisioner)
+	err := p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !p.config.ReportStatus {
+		t.Fatal("Expected report_status to default to true")
+	}
+
+	err = p.Provision(ui, comm)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !comm.ran("packer-dsc-status") {
+		t.Fatalf("Expected status to be reported, but commands were: %v", comm.Commands)
+	}
+
+	// A failed status fails the provisioner
+	comm = &testCommunicator{
+		ExitStatuses: map[string]int{"packer-dsc-status": 1},
+	}
+	err = p.Provision(ui, comm)
+	if err == nil {
+		t.Fatalf("Expected error but got none")
+	}
+
+	// Unless disabled
+	config["report_status"] = false
+	comm = new(testCommunicator)
+	p = new(Provisioner)
+	err = p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	err = p.Provision(ui, comm)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if comm.ran("packer-dsc-status") {
+		t.Fatal("Expected status not to be reported")
+	}
+}
+
+func TestProvisionerProvision_whatIf(t *testing.T) {
+	config := testConfig()
+	config["what_if"] = true
+	ui := &packer.MachineReadableUi{
+		Writer: ioutil.Discard,
+	}
+	comm := new(testCommunicator)
+
+	p := new(Provisioner)
+	err := p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	err = p.Provision(ui, comm)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	runner := runnerScript(t, comm)
+	if !strings.HasSuffix(runner, "Start-DscConfiguration -Force -Wait -Verbose -Path $StagingPath -WhatIf") {
+		t.Fatalf("Expected -WhatIf to be passed to Start-DscConfiguration but got:\n\n%s", runner)
+	}
+	if comm.ran("packer-dsc-status") {
+		t.Fatal("Expected status not to be reported for a -WhatIf run")
+	}
+}
+
+func TestProvisionerProvision_workingDir(t *testing.T) {
+	config := testConfig()
+	config["working_dir"] = "C:/build"
+	ui := &packer.MachineReadableUi{
+		Writer: ioutil.Discard,
+	}
+	comm := new(testCommunicator)
+
+	p := new(Provisioner)
+	err := p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	err = p.Provision(ui, comm)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	runner := runnerScript(t, comm)
+	if !strings.Contains(runner, "cd \"C:/build\"\n\n# Set the local PowerShell Module environment path") {
+		t.Fatalf("Expected the runner to change to the working directory first but got:\n\n%s", runner)
+	}
+}
+
+func TestProvisionerProvision_cleanStagingDir(t *testing.T) {
+	config := testConfig()
+	ui := &packer.MachineReadableUi{
+		Writer: ioutil.Discard,
+	}
+	comm := new(testCommunicator)
+
+	p := new(Provisioner)
+	err := p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if p.config.CleanStagingDir {
+		t.Fatal("Expected clean_staging_dir to default to false")
+	}
+
+	config["clean_staging_dir"] = true
+	p = new(Provisioner)
+	err = p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	err = p.Provision(ui, comm)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if !comm.ran("Remove-Item '/tmp/packer-dsc-pull' -Recurse -Force") {
+		t.Fatalf("Expected staging directory to be removed, but commands were: %v", comm.Commands)
+	}
+
+	for _, script := range []string{"packer-dsc-runner", "packer-dsc-status"} {
+		re := regexp.MustCompile(`Remove-Item '/tmp/` + script + `-?[0-9a-f-]+\.ps1'`)
+		removed := false
+		for _, command := range comm.Commands {
+			if re.MatchString(command) {
+				removed = true
+			}
+		}
+		if !removed {
+			t.Fatalf("Expected %s script to be removed, but commands were: %v", script, comm.Commands)
+		}
+	}
+}
+
+func TestProvisionerProvision_cleanupRemotePath(t *testing.T) {
+	config := testConfig()
+	delete(config, "cleanup_remote_path")
+	ui := &packer.MachineReadableUi{
+		Writer: ioutil.Discard,
+	}
+	comm := new(testCommunicator)
+
+	p := new(Provisioner)
+	err := p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !p.config.CleanupRemotePath {
+		t.Fatal("Expected cleanup_remote_path to default to true")
+	}
+
+	// The default staging directory is Packer's own
+	err = p.Provision(ui, comm)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !comm.ran("Remove-Item '/tmp/packer-dsc-pull' -Recurse -Force") {
+		t.Fatalf("Expected staging directory to be removed, but commands were: %v", comm.Commands)
+	}
+
+	// Only what Packer created within a given staging_dir is removed
+	config["staging_dir"] = "C:/Windows/Temp"
+	p = new(Provisioner)
+	err = p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	comm = new(testCommunicator)
+	err = p.Provision(ui, comm)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	for _, path := range []string{"manifest", "provisioner_test.go", "staging"} {
+		if !comm.ran("Remove-Item 'C:/Windows/Temp/" + path + "' -Recurse -Force") {
+			t.Fatalf("Expected %s to be removed, but commands were: %v", path, comm.Commands)
+		}
+	}
+	if comm.ran("Remove-Item 'C:/Windows/Temp' ") || comm.ran("Remove-Item 'C:/Windows/Temp/.' ") {
+		t.Fatalf("Expected staging_dir itself to be kept, but commands were: %v", comm.Commands)
+	}
+	if comm.ran("Remove-Item '${env:programfiles}") {
+		t.Fatalf("Expected global DSC Resources to be kept, but commands were: %v", comm.Commands)
+	}
+
+	re := regexp.MustCompile(`Remove-Item '/tmp/packer-dsc-runner-[0-9a-f-]+\.ps1'`)
+	removed := false
+	for _, command := range comm.Commands {
+		if re.MatchString(command) {
+			removed = true
+		}
+	}
+	if !removed {
+		t.Fatalf("Expected the DSC runner to be removed, but commands were: %v", comm.Commands)
+	}
+
+	// clean_staging_dir removes the whole of it
+	config["clean_staging_dir"] = true
+	p = new(Provisioner)
+	err = p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	comm = new(testCommunicator)
+	err = p.Provision(ui, comm)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !comm.ran("Remove-Item 'C:/Windows/Temp' -Recurse -Force") {
+		t.Fatalf("Expected staging_dir to be removed, but commands were: %v", comm.Commands)
+	}
+}
+
+func TestProvisionerPrepare_stagingDirTemplate(t *testing.T) {
+	config := testConfig()
+	config["packer_build_name"] = "windows-2016"
+	config["staging_dir"] = "C:/Windows/Temp/packer-dsc-{{build_name}}-{{uuid}}"
+
+	p := new(Provisioner)
+	err := p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	re := regexp.MustCompile(`^C:/Windows/Temp/packer-dsc-windows-2016-[0-9a-f-]+$`)
+	if !re.MatchString(p.config.StagingDir) {
+		t.Fatalf("Expected staging_dir to be interpolated but got: %s", p.config.StagingDir)
+	}
+	if p.config.WorkingDir != p.config.StagingDir {
+		t.Fatalf("Expected working_dir to default to the interpolated staging_dir but got: %s", p.config.WorkingDir)
+	}
+}
+
+func TestProvisionerProvision_tempDir(t *testing.T) {
+	config := testConfig()
+	config["temp_dir"] = "C:/Build/Temp/"
+	ui := &packer.MachineReadableUi{
+		Writer: ioutil.Discard,
+	}
+
+	p := new(Provisioner)
+	err := p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if p.config.StagingDir != "C:/Build/Temp/packer-dsc-pull" {
+		t.Fatalf("Expected staging_dir to default to within temp_dir but got: %s", p.config.StagingDir)
+	}
+
+	comm := new(testCommunicator)
+	err = p.Provision(ui, comm)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	for path := range comm.uploads {
+		if !strings.HasPrefix(path, "C:/Build/Temp/") {
+			t.Fatalf("Expected everything to be uploaded within temp_dir but got: %s", path)
+		}
+	}
+	if comm.ran("-Path C:/Build/Temp\"") {
+		t.Fatal("Expected temp_dir to be created along with the staging directory")
+	}
+
+	// Created separately when the staging directory is elsewhere
+	config["staging_dir"] = "D:/staging"
+	p = new(Provisioner)
+	err = p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	comm = new(testCommunicator)
+	err = p.Provision(ui, comm)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !comm.ran("-Path C:/Build/Temp\"") {
+		t.Fatalf("Expected temp_dir to be created, commands were: %v", comm.Commands)
+	}
+
+	config["temp_dir"] = "Temp"
+	p = new(Provisioner)
+	err = p.Prepare(config)
+	if err == nil || !strings.Contains(err.Error(), "temp_dir must be an absolute path") {
+		t.Fatalf("Expected temp_dir error but got: %v", err)
+	}
+}
+
+func TestProvisionerProvision_cleanupOnFailure(t *testing.T) {
+	config := testConfig()
+	ui := &packer.MachineReadableUi{
+		Writer: ioutil.Discard,
+	}
+	comm := &testCommunicator{
+		ExitStatuses: map[string]int{"packer-dsc-runner": 1},
+	}
+
+	p := new(Provisioner)
+	err := p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	err = p.Provision(ui, comm)
+	if err == nil {
+		t.Fatal("Expected error but got none")
+	}
+	if comm.ran("Remove-Item") {
+		t.Fatal("Expected nothing to be removed by default")
+	}
+
+	config["cleanup_on_failure"] = true
+	comm = &testCommunicator{
+		ExitStatuses: map[string]int{"packer-dsc-runner": 1},
+	}
+	p = new(Provisioner)
+	err = p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	err = p.Provision(ui, comm)
+	if err == nil || !strings.Contains(err.Error(), "DSC exited with a non-zero exit status: 1") {
+		t.Fatalf("Expected DSC error but got: %v", err)
+	}
+	if !comm.ran("Remove-Item '/tmp/packer-dsc-pull' -Recurse -Force") {
+		t.Fatalf("Expected staging directory to be removed, but commands were: %v", comm.Commands)
+	}
+	if !comm.ran("Remove-Item '/tmp/packer-dsc-runner") {
+		t.Fatalf("Expected runner script to be removed, but commands were: %v", comm.Commands)
+	}
+}
+
+func TestProvisionerProvision_verbose(t *testing.T) {
+	config := testConfig()
+	config["verbose"] = false
+	ui := &packer.MachineReadableUi{
+		Writer: ioutil.Discard,
+	}
+	comm := new(testCommunicator)
+
+	p := new(Provisioner)
+	err := p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	err = p.Provision(ui, comm)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	runner := runnerScript(t, comm)
+	if !strings.HasSuffix(runner, "Start-DscConfiguration -Force -Wait -Path $StagingPath") {
+		t.Fatalf("Expected DSC to be run without -Verbose but got:\n\n%s", runner)
+	}
+}
+
+// hangingCommunicator starts commands that never exit
+type hangingCommunicator struct {
+	packer.MockCommunicator
+
+	started chan *packer.RemoteCmd
+}
+
+func (c *hangingCommunicator) Start(rc *packer.RemoteCmd) error {
+	c.started <- rc
+	return nil
+}
+
+// failingCommunicator fails to start any command
+type failingCommunicator struct {
+	packer.MockCommunicator
+}
+
+func (c *failingCommunicator) Start(rc *packer.RemoteCmd) error {
+	return errors.New("http response error: 401 - invalid content type")
+}
+
+func TestProvisionerProvision_startError(t *testing.T) {
+	config := testConfig()
+	ui := &packer.MachineReadableUi{
+		Writer: ioutil.Discard,
+	}
+
+	p := new(Provisioner)
+	err := p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	err = p.Provision(ui, new(failingCommunicator))
+	if err == nil {
+		t.Fatal("Expected error but got none")
+	}
+	if !strings.Contains(err.Error(), "Error starting remote command") || !strings.Contains(err.Error(), "401 - invalid content type") {
+		t.Fatalf("Expected the communicator error with context but got: %s", err)
+	}
+}
+
+func TestProvisionerCancel(t *testing.T) {
+	config := testConfig()
+	ui := &packer.MachineReadableUi{
+		Writer: ioutil.Discard,
+	}
+	comm := &hangingCommunicator{
+		started: make(chan *packer.RemoteCmd, 1),
+	}
+
+	p := new(Provisioner)
+	err := p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Cancelling before provisioning is a no-op
+	p.Cancel()
+
+	done := make(chan error)
+	go func() {
+		done <- p.Provision(ui, comm)
+	}()
+
+	<-comm.started
+	p.Cancel()
+
+	select {
+	case err := <-done:
+		if !strings.Contains(err.Error(), context.Canceled.Error()) {
+			t.Fatalf("Expected cancellation error but got: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Provision was not cancelled")
+	}
+
+	// Cancelling twice is safe
+	p.Cancel()
+}
+
+func TestProvisioner_retryableCancel(t *testing.T) {
+	p := new(Provisioner)
+	p.config.StartRetryTimeout = time.Hour
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := p.retryable(ctx, func() error {
+		return errors.New("failed")
+	})
+	if err != context.Canceled {
+		t.Fatalf("Expected cancellation error but got: %v", err)
+	}
+}
+
+func TestProvisioner_retryableFatal(t *testing.T) {
+	p := new(Provisioner)
+	p.config.StartRetryTimeout = time.Hour
+
+	attempts := 0
+	err := p.retryable(context.Background(), func() error {
+		attempts++
+		return p.communicatorError(errors.New("http response error: 401 - invalid content type"))
+	})
+	if err == nil || err.Error() != "http response error: 401 - invalid content type" {
+		t.Fatalf("Expected the authentication error but got: %v", err)
+	}
+	if attempts != 1 {
+		t.Fatalf("Expected 1 attempt but got %d", attempts)
+	}
+
+	if _, ok := p.communicatorError(errors.New("connection refused")).(*fatalError); ok {
+		t.Fatal("Expected a connection error to be retryable")
+	}
+
+	err = p.communicatorError(errors.New("http error 500: <f:Message>The WinRM client sent a request to the remote WS-Management service and was notified that the request size exceeded the configured MaxEnvelopeSize quota.</f:Message>"))
+	if _, ok := err.(*fatalError); !ok {
+		t.Fatal("Expected a MaxEnvelopeSize fault to be fatal")
+	}
+	if !strings.Contains(err.Error(), "MaxEnvelopeSizekb") {
+		t.Fatalf("Expected advice on raising the quota but got: %s", err)
+	}
+}
+
+func TestProvisioner_retryableStatusCodes(t *testing.T) {
+	config := testConfig()
+	p := new(Provisioner)
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	for _, e := range []string{"http error 503: <s:Envelope/>", "http response error: 500 - unexpected EOF"} {
+		if _, ok := p.communicatorError(errors.New(e)).(*fatalError); ok {
+			t.Fatalf("Expected '%s' to be retryable", e)
+		}
+	}
+	if _, ok := p.communicatorError(errors.New("http error 404: <s:Envelope/>")).(*fatalError); !ok {
+		t.Fatal("Expected a 404 to be fatal")
+	}
+
+	config["retryable_status_codes"] = []int{404}
+	p = new(Provisioner)
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, ok := p.communicatorError(errors.New("http error 503: <s:Envelope/>")).(*fatalError); !ok {
+		t.Fatal("Expected a 503 to be fatal")
+	}
+	if _, ok := p.communicatorError(errors.New("http error 404: <s:Envelope/>")).(*fatalError); ok {
+		t.Fatal("Expected a 404 to be retryable")
+	}
+
+	for _, code := range []int{401, 200} {
+		config["retryable_status_codes"] = []int{code}
+		p = new(Provisioner)
+		if err := p.Prepare(config); err == nil {
+			t.Fatalf("Expected %d to be rejected", code)
+		}
+	}
+}
+
+func TestProvisionerPrepare_minPowerShellVersion(t *testing.T) {
+	config := testConfig()
+	config["min_powershell_version"] = "5.0"
+	p := new(Provisioner)
+	err := p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	config["min_powershell_version"] = "five"
+	p = new(Provisioner)
+	err = p.Prepare(config)
+	if err == nil {
+		t.Fatal("should have error")
+	}
+}
+
+func TestProvisionerProvision_minPowerShellVersion(t *testing.T) {
+	config := testConfig()
+	config["min_powershell_version"] = "5.0"
+	ui := &packer.MachineReadableUi{
+		Writer: ioutil.Discard,
+	}
+	comm := &testCommunicator{
+		Stdout: map[string]string{"PSVersionTable": "5.1.14393.1198\r\n"},
+	}
+
+	p := new(Provisioner)
+	err := p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	err = p.Provision(ui, comm)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// An older version fails before anything is run
+	comm = &testCommunicator{
+		Stdout: map[string]string{"PSVersionTable": "4.0\r\n"},
+	}
+	err = p.Provision(ui, comm)
+	if err == nil || !strings.Contains(err.Error(), "PowerShell 4.0.0 is installed, but min_powershell_version requires 5.0.0 or later") {
+		t.Fatalf("Expected PowerShell version error but got: %v", err)
+	}
+	if len(comm.Commands) != 1 {
+		t.Fatalf("Expected only the version check to run, but commands were: %v", comm.Commands)
+	}
+}
+
+func TestProvisionerProvision_executeTimeout(t *testing.T) {
+	config := testConfig()
+	config["execute_timeout"] = "10ms"
+	ui := &packer.MachineReadableUi{
+		Writer: ioutil.Discard,
+	}
+	comm := &testCommunicator{
+		Hang: "packer-dsc-runner",
+	}
+
+	p := new(Provisioner)
+	err := p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if p.config.ExecuteTimeout != 10*time.Millisecond {
+		t.Fatalf("Expected execute_timeout to be 10ms but got %s", p.config.ExecuteTimeout)
+	}
+
+	err = p.Provision(ui, comm)
+	if err == nil || !strings.Contains(err.Error(), "DSC did not complete within the execute_timeout of 10ms") {
+		t.Fatalf("Expected timeout error but got: %v", err)
+	}
+	if comm.ran("Stop-DscConfiguration") {
+		t.Fatal("Expected DSC not to be stopped without cleanup_on_failure")
+	}
+
+	// The abandoned run is stopped before its files are removed
+	config["cleanup_on_failure"] = true
+	p = new(Provisioner)
+	err = p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	comm = &testCommunicator{
+		Hang: "& { /tmp/packer-dsc-runner",
+	}
+	err = p.Provision(ui, comm)
+	if err == nil || !strings.Contains(err.Error(), "DSC did not complete within the execute_timeout of 10ms") {
+		t.Fatalf("Expected timeout error but got: %v", err)
+	}
+	stop, remove := -1, -1
+	for i, command := range comm.Commands {
+		if strings.Contains(command, "Stop-DscConfiguration -Force") && stop < 0 {
+			stop = i
+		}
+		if strings.Contains(command, "Remove-Item '/tmp/packer-dsc-pull' -Recurse -Force") && remove < 0 {
+			remove = i
+		}
+	}
+	if stop < 0 || remove < 0 || stop > remove {
+		t.Fatalf("Expected DSC to be stopped before the staging directory is removed, but commands were: %v", comm.Commands)
+	}
+
+	// Nothing is removed from under a run which can't be stopped
+	p = new(Provisioner)
+	err = p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	comm = &testCommunicator{
+		Hang:         "& { /tmp/packer-dsc-runner",
+		ExitStatuses: map[string]int{"Stop-DscConfiguration": 1},
+	}
+	err = p.Provision(ui, comm)
+	if err == nil || !strings.Contains(err.Error(), "DSC did not complete within the execute_timeout of 10ms") {
+		t.Fatalf("Expected timeout error but got: %v", err)
+	}
+	if comm.ran("Remove-Item") {
+		t.Fatalf("Expected nothing to be removed, but commands were: %v", comm.Commands)
+	}
+
+	config["execute_timeout"] = "-1s"
+	p = new(Provisioner)
+	err = p.Prepare(config)
+	if err == nil {
+		t.Fatal("should have error")
+	}
+}
+
+func TestProvisionerProvision_totalTimeout(t *testing.T) {
+	config := testConfig()
+	config["total_timeout"] = "10ms"
+	ui := &packer.MachineReadableUi{
+		Writer: ioutil.Discard,
+	}
+	comm := &testCommunicator{
+		Hang: "packer-dsc-runner",
+	}
+
+	p := new(Provisioner)
+	err := p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if p.config.TotalTimeout != 10*time.Millisecond {
+		t.Fatalf("Expected total_timeout to be 10ms but got %s", p.config.TotalTimeout)
+	}
+
+	err = p.Provision(ui, comm)
+	if err == nil || !strings.Contains(err.Error(), "Provisioning did not complete within the total_timeout of 10ms") {
+		t.Fatalf("Expected timeout error but got: %v", err)
+	}
+	if comm.ran("Remove-Item") {
+		t.Fatal("Expected nothing to be removed by default")
+	}
+
+	// Uploaded files are still removed with cleanup_on_failure
+	config["cleanup_on_failure"] = true
+	p = new(Provisioner)
+	err = p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	comm = &testCommunicator{
+		Hang: "& { /tmp/packer-dsc-runner",
+	}
+	err = p.Provision(ui, comm)
+	if err == nil || !strings.Contains(err.Error(), "Provisioning did not complete within the total_timeout of 10ms") {
+		t.Fatalf("Expected timeout error but got: %v", err)
+	}
+	if !comm.ran("Remove-Item '/tmp/packer-dsc-pull' -Recurse -Force") {
+		t.Fatalf("Expected staging directory to be removed, but commands were: %v", comm.Commands)
+	}
+
+	config["total_timeout"] = "-1s"
+	p = new(Provisioner)
+	err = p.Prepare(config)
+	if err == nil {
+		t.Fatal("should have error")
+	}
+}
+
+func TestProvisionerProvision_debug(t *testing.T) {
+	config := testConfig()
+	config["debug"] = true
+	ui := &packer.MachineReadableUi{
+		Writer: ioutil.Discard,
+	}
+	comm := new(testCommunicator)
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	p := new(Provisioner)
+	err := p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	err = p.Provision(ui, comm)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	runner := runnerScript(t, comm)
+	if !strings.HasPrefix(runner, "$env:PACKER_BUILDER_TYPE = ''\n$env:PACKER_BUILD_NAME = ''\n$DebugPreference = 'Continue'\n") {
+		t.Fatalf("Expected the runner to set $DebugPreference but got:\n\n%s", runner)
+	}
+
+	for _, expected := range []string{"Rendered DSC runner:", "DSC MOF path: /tmp/packer-dsc-pull/staging"} {
+		if !strings.Contains(logs.String(), expected) {
+			t.Fatalf("Expected log to contain '%s' but got:\n\n%s", expected, logs.String())
+		}
+	}
+}
+
+func TestProvisionerProvision_verifyUpload(t *testing.T) {
+	config := testConfig()
+	ui := &packer.MachineReadableUi{
+		Writer: ioutil.Discard,
+	}
+	comm := &testCommunicator{
+		CorruptUploads: 1,
+	}
+	retryableSleep = 1 * time.Millisecond
+	defer func() { retryableSleep = 2 * time.Second }()
+
+	p := new(Provisioner)
+	err := p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !p.config.VerifyUpload {
+		t.Fatal("Expected verify_upload to default to true")
+	}
+
+	// The corrupt upload is retried
+	err = p.Provision(ui, comm)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if comm.CorruptUploads != 0 {
+		t.Fatal("Expected an upload to have been corrupted")
+	}
+	for path, data := range comm.uploads {
+		if string(data) == "corrupt" {
+			t.Fatalf("Expected the corrupt upload of %s to be retried", path)
+		}
+	}
+
+	// Without verification the corrupt upload is left as it is
+	config["verify_upload"] = false
+	comm = &testCommunicator{
+		CorruptUploads: 1,
+	}
+	p = new(Provisioner)
+	err = p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	err = p.Provision(ui, comm)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	corrupt := false
+	for _, data := range comm.uploads {
+		if string(data) == "corrupt" {
+			corrupt = true
+		}
+	}
+	if !corrupt {
+		t.Fatal("Expected the upload not to be verified")
+	}
+}
+
+func TestProvisionerPrepare_executeCommand(t *testing.T) {
+	config := testConfig()
+	config["execute_command"] = `cd "{{.WorkingDir}}"; Start-DscConfiguration -Path "{{.MofPath}}"`
+	p := new(Provisioner)
+	err := p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Unknown template variables are caught before provisioning
+	config["execute_command"] = `cd "{{.Pathh}}"`
+	p = new(Provisioner)
+	err = p.Prepare(config)
+	if err == nil || !strings.Contains(err.Error(), "execute_command is invalid") {
+		t.Fatalf("Expected execute_command error but got: %v", err)
+	}
+
+	config["execute_command"] = `cd "{{.WorkingDir"`
+	p = new(Provisioner)
+	err = p.Prepare(config)
+	if err == nil {
+		t.Fatal("should have error")
+	}
+}
+
+func TestProvisionerPrepare_powershellExecutable(t *testing.T) {
+	config := testConfig()
+	p := new(Provisioner)
+	err := p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if p.config.PowerShellExecutable != "powershell" {
+		t.Fatalf("Expected powershell_executable to default to powershell but got %s", p.config.PowerShellExecutable)
+	}
+
+	config["powershell_executable"] = "C:/Program Files/PowerShell/7/pwsh.exe"
+	p = new(Provisioner)
+	err = p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	expected := `"C:/Program Files/PowerShell/7/pwsh.exe" -ExecutionPolicy Bypass -Command "& { Get-Item; exit $LastExitCode}"`
+	if command := p.powershellCommand("Get-Item"); command != expected {
+		t.Fatalf("Expected command '%s' but got '%s'", expected, command)
+	}
+
+	config["powershell_executable"] = `pwsh"`
+	p = new(Provisioner)
+	err = p.Prepare(config)
+	if err == nil {
+		t.Fatal("should have error")
+	}
+}
+
+func TestProvisionerProvision_powershellExecutable(t *testing.T) {
+	config := testConfig()
+	config["powershell_executable"] = "pwsh"
+	config["execute_command"] = `{{.PowerShell}} -Command Start-DscConfiguration`
+	ui := &packer.MachineReadableUi{
+		Writer: ioutil.Discard,
+	}
+	comm := new(testCommunicator)
+
+	p := new(Provisioner)
+	err := p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	err = p.Provision(ui, comm)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	for _, command := range comm.Commands {
+		if !strings.HasPrefix(command, "pwsh ") {
+			t.Fatalf("Expected every command to be run with pwsh but got: %s", command)
+		}
+	}
+
+	re := regexp.MustCompile(`pwsh -ExecutionPolicy Bypass -Command "& { (/tmp/packer-dsc-runner-[0-9a-f-]+\.ps1)`)
+	m := re.FindStringSubmatch(strings.Join(comm.Commands, "\n"))
+	if m == nil {
+		t.Fatalf("Expected the runner to be run, but commands were: %v", comm.Commands)
+	}
+	if runner := string(comm.uploads[m[1]]); !strings.HasSuffix(runner, "pwsh -Command Start-DscConfiguration") {
+		t.Fatalf("Expected {{.PowerShell}} to be interpolated but got:\n\n%s", runner)
+	}
+}
+
+func TestProvisioner_configurationArgs(t *testing.T) {
+	p := new(Provisioner)
+	p.config.ConfigurationParams = map[string]string{
+		"-Website": "Bean'stalk",
+		"Port":     "8080",
+		"-Force":   "",
+		"Path":     "$env:TEMP",
+	}
+
+	expected := `-Force -Path '$env:TEMP' -Port '8080' -Website 'Bean''stalk'`
+	if args := p.configurationArgs(); args != expected {
+		t.Fatalf("Expected '%s' but got '%s'", expected, args)
+	}
+}
+
+func TestProvisionerProvision_reportPath(t *testing.T) {
+	td, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	defer os.RemoveAll(td)
+
+	config := testConfig()
+	config["report_path"] = td + "/report.json"
+	ui := &packer.MachineReadableUi{
+		Writer: ioutil.Discard,
+	}
+	comm := new(testCommunicator)
+	comm.DownloadData = `{"Status": "Success"}`
+
+	p := new(Provisioner)
+	err = p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	err = p.Provision(ui, comm)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if comm.DownloadPath != "/tmp/packer-dsc-pull/dsc-report.json" {
+		t.Fatalf("Expected the report to be downloaded but got: %s", comm.DownloadPath)
+	}
+	report, err := ioutil.ReadFile(td + "/report.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(report) != comm.DownloadData {
+		t.Fatalf("Expected the report to be saved but got: %s", report)
+	}
+
+	// A failed report fails the provisioner
+	comm = &testCommunicator{
+		ExitStatuses: map[string]int{"packer-dsc-report": 1},
+	}
+	err = p.Provision(ui, comm)
+	if err == nil || !strings.Contains(err.Error(), "Error saving DSC report") {
+		t.Fatalf("Expected report error but got: %v", err)
+	}
+}
+
+func TestProvisionerProvision_statePath(t *testing.T) {
+	td, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	defer os.RemoveAll(td)
+
+	config := testConfig()
+	config["state_path"] = td + "/state.json"
+	ui := &packer.MachineReadableUi{
+		Writer: ioutil.Discard,
+	}
+	comm := new(testCommunicator)
+	comm.DownloadData = `[{"ResourceId": "[File]Foo", "Ensure": "Present"}]`
+
+	p := new(Provisioner)
+	err = p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	err = p.Provision(ui, comm)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if comm.DownloadPath != "/tmp/packer-dsc-pull/dsc-state.json" {
+		t.Fatalf("Expected the state to be downloaded but got: %s", comm.DownloadPath)
+	}
+	state, err := ioutil.ReadFile(td + "/state.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(state) != comm.DownloadData {
+		t.Fatalf("Expected the state to be saved but got: %s", state)
+	}
+
+	// No state is only a warning
+	os.Remove(td + "/state.json")
+	comm = &testCommunicator{
+		ExitStatuses: map[string]int{"packer-dsc-state": noStateExitStatus},
+	}
+	err = p.Provision(ui, comm)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := os.Stat(td + "/state.json"); !os.IsNotExist(err) {
+		t.Fatalf("Expected no state to be saved but got: %v", err)
+	}
+
+	comm = &testCommunicator{
+		ExitStatuses: map[string]int{"packer-dsc-state": 1},
+	}
+	err = p.Provision(ui, comm)
+	if err == nil || !strings.Contains(err.Error(), "Error saving DSC state") {
+		t.Fatalf("Expected state error but got: %v", err)
+	}
+}
+
+func TestProvisionerPrepare_retryInterval(t *testing.T) {
+	config := testConfig()
+	p := new(Provisioner)
+	err := p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if p.config.RetryInterval != 2*time.Second {
+		t.Fatalf("Expected retry_interval to default to 2s but got %s", p.config.RetryInterval)
+	}
+
+	config["retry_interval"] = "10s"
+	config["retry_backoff_multiplier"] = 1.5
+	config["retry_max_interval"] = "2m"
+	p = new(Provisioner)
+	err = p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if p.config.RetryInterval != 10*time.Second || p.config.RetryBackoffMultiplier != 1.5 || p.config.RetryMaxInterval != 2*time.Minute {
+		t.Fatalf("Unexpected retry settings: %#v", p.config)
+	}
+
+	config["retry_backoff_multiplier"] = 0.5
+	p = new(Provisioner)
+	err = p.Prepare(config)
+	if err == nil {
+		t.Fatal("should have error")
+	}
+}
+
+func TestProvisioner_retryableBackoff(t *testing.T) {
+	p := new(Provisioner)
+	p.config.StartRetryTimeout = time.Hour
+	p.config.RetryInterval = time.Millisecond
+	p.config.RetryBackoffMultiplier = 4
+	p.config.RetryMaxInterval = 20 * time.Millisecond
+
+	var attempts []time.Time
+	err := p.retryable(context.Background(), func() error {
+		attempts = append(attempts, time.Now())
+		if len(attempts) < 5 {
+			return errors.New("failed")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// 1ms, 4ms, 16ms, then capped at 20ms
+	if elapsed := attempts[4].Sub(attempts[0]); elapsed < 41*time.Millisecond {
+		t.Fatalf("Expected the interval to back off but retries took %s", elapsed)
+	}
+	if gap := attempts[4].Sub(attempts[3]); gap < 20*time.Millisecond || gap > time.Second {
+		t.Fatalf("Expected the interval to be capped at 20ms but got %s", gap)
+	}
+}
+
+func TestProvisioner_retryableMaxRetries(t *testing.T) {
+	p := new(Provisioner)
+	p.config.StartRetryTimeout = time.Hour
+	p.config.RetryInterval = time.Millisecond
+	p.config.MaxRetries = 3
+
+	attempts := 0
+	err := p.retryable(context.Background(), func() error {
+		attempts++
+		return errors.New("connection refused")
+	})
+	if attempts != 3 {
+		t.Fatalf("Expected 3 attempts but got %d", attempts)
+	}
+	if err == nil || !strings.Contains(err.Error(), "connection refused (gave up after 3 attempts in ") {
+		t.Fatalf("Expected the attempts to be reported but got: %v", err)
+	}
+
+	// Still limited by time
+	p.config.StartRetryTimeout = 5 * time.Millisecond
+	p.config.MaxRetries = 0
+	err = p.retryable(context.Background(), func() error {
+		return errors.New("connection refused")
+	})
+	if err == nil || !strings.Contains(err.Error(), "gave up after") {
+		t.Fatalf("Expected the attempts to be reported but got: %v", err)
+	}
+}
+
+func TestProvisionerProvision_outputMofDirectory(t *testing.T) {
+	td, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	defer os.RemoveAll(td)
+
+	config := testConfig()
+	config["output_mof_directory"] = td + "/mof"
+	ui := &packer.MachineReadableUi{
+		Writer: ioutil.Discard,
+	}
+	comm := new(testCommunicator)
+	comm.DownloadData = "instance of MSFT_Configuration {};"
+
+	p := new(Provisioner)
+	err = p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := os.Stat(td + "/mof"); err != nil {
+		t.Fatalf("Expected output_mof_directory to be created: %s", err)
+	}
+
+	err = p.Provision(ui, comm)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if comm.DownloadPath != "/tmp/packer-dsc-pull/staging/localhost.meta.mof" {
+		t.Fatalf("Expected the meta MOF to be downloaded but got: %s", comm.DownloadPath)
+	}
+	for _, name := range []string{"localhost.mof", "localhost.meta.mof"} {
+		mof, err := ioutil.ReadFile(filepath.Join(td, "mof", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(mof) != comm.DownloadData {
+			t.Fatalf("Expected %s to be saved but got: %s", name, mof)
+		}
+	}
+
+	// Must not be a file
+	config["output_mof_directory"] = "./provisioner_test.go"
+	p = new(Provisioner)
+	err = p.Prepare(config)
+	if err == nil {
+		t.Fatal("should have error")
+	}
+}
+
+func TestProvisionerProvision_mofOutputPath(t *testing.T) {
+	config := testConfig()
+	config["packer_build_name"] = "web"
+	config["mof_output_path"] = "C:/Builds/{{build_name}}"
+	config["clean_staging_dir"] = true
+	ui := &packer.MachineReadableUi{
+		Writer: ioutil.Discard,
+	}
+	comm := new(testCommunicator)
+
+	p := new(Provisioner)
+	err := p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if p.config.MofOutputPath != "C:/Builds/web" {
+		t.Fatalf("Expected mof_output_path to be interpolated but got: %s", p.config.MofOutputPath)
+	}
+
+	err = p.Provision(ui, comm)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	runner := runnerScript(t, comm)
+	if !strings.Contains(runner, `$StagingPath = "C:/Builds/web"`) || strings.Contains(runner, `Join-Path "/tmp/packer-dsc-pull" "staging"`) {
+		t.Fatalf("Expected the Configuration to be compiled into mof_output_path but got:\n\n%s", runner)
+	}
+	if !comm.ran("Remove-Item 'C:/Builds/web' -Recurse -Force") {
+		t.Fatalf("Expected mof_output_path to be cleaned up, commands were: %v", comm.Commands)
+	}
+}
+
+func TestProvisionerProvision_cleanStagingDirWorkingDir(t *testing.T) {
+	config := testConfig()
+	config["working_dir"] = "C:/Builds"
+	config["clean_staging_dir"] = true
+	ui := &packer.MachineReadableUi{
+		Writer: ioutil.Discard,
+	}
+	comm := new(testCommunicator)
+
+	p := new(Provisioner)
+	err := p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	err = p.Provision(ui, comm)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The MOF is compiled within working_dir, outside the staging directory
+	if !comm.ran("Remove-Item 'C:/Builds/staging' -Recurse -Force") {
+		t.Fatalf("Expected the compiled MOF to be removed, but commands were: %v", comm.Commands)
+	}
+	if comm.ran("Remove-Item 'C:/Builds' ") {
+		t.Fatalf("Expected working_dir itself to be kept, but commands were: %v", comm.Commands)
+	}
+
+	// Within the staging directory, it is removed along with it
+	config["working_dir"] = "/TMP/Packer-DSC-Pull"
+	p = new(Provisioner)
+	err = p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	comm = new(testCommunicator)
+	err = p.Provision(ui, comm)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if comm.ran("/staging' -Recurse -Force") {
+		t.Fatalf("Expected only the staging directory to be removed, but commands were: %v", comm.Commands)
+	}
+}
+
+func TestProvisionerProvision_binary(t *testing.T) {
+	tf, err := ioutil.TempFile("", "packer")
+	if err != nil {
+		t.Fatalf("error tempfile: %s", err)
+	}
+	defer os.Remove(tf.Name())
+	tf.WriteString("Configuration Test {\n}\r\n")
+	tf.Close()
+
+	config := testConfig()
+	config["manifest_file"] = tf.Name()
+	ui := &packer.MachineReadableUi{
+		Writer: ioutil.Discard,
+	}
+	remoteManifest := "/tmp/packer-dsc-pull/manifest/" + filepath.Base(tf.Name())
+
+	// Line endings are converted by default
+	comm := new(testCommunicator)
+	p := new(Provisioner)
+	err = p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	err = p.Provision(ui, comm)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if manifest := string(comm.uploads[remoteManifest]); manifest != "Configuration Test {\r\n}\r\n" {
+		t.Fatalf("Expected CRLF line endings but got: %q", manifest)
+	}
+
+	// Binary files are uploaded as-is
+	config["binary"] = true
+	comm = new(testCommunicator)
+	p = new(Provisioner)
+	err = p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	err = p.Provision(ui, comm)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if manifest := string(comm.uploads[remoteManifest]); manifest != "Configuration Test {\n}\r\n" {
+		t.Fatalf("Expected the manifest to be unchanged but got: %q", manifest)
+	}
+
+	// UTF-16 is never converted
+	utf16 := []byte{0xFF, 0xFE, 'a', 0, '\n', 0}
+	if converted := windowsLineEndings(utf16); !bytes.Equal(converted, utf16) {
+		t.Fatalf("Expected UTF-16 to be unchanged but got: %v", converted)
+	}
+}
+
+func TestProvisionerProvision_chunkedUpload(t *testing.T) {
+	tf, err := ioutil.TempFile("", "localhost*.mof")
+	if err != nil {
+		t.Fatalf("error tempfile: %s", err)
+	}
+	defer os.Remove(tf.Name())
+
+	// Two and a half chunks
+	mof := bytes.Repeat([]byte("instance of MSFT_Configuration {};\n"), 5*uploadChunkSize/2/35)
+	tf.Write(mof)
+	tf.Close()
+
+	config := testConfig()
+	config["mof_path"] = tf.Name()
+	config["chunked_upload"] = true
+	config["report_status"] = false
+	delete(config, "manifest_file")
+	delete(config, "configuration_file")
+	delete(config, "configuration_params")
+	ui := &packer.MachineReadableUi{
+		Writer: ioutil.Discard,
+	}
+	comm := new(testCommunicator)
+
+	p := new(Provisioner)
+	err = p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	err = p.Provision(ui, comm)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	remoteMof := "/tmp/packer-dsc-pull/mof/" + filepath.Base(tf.Name())
+	if !bytes.Equal(comm.uploads[remoteMof], mof) {
+		t.Fatalf("Expected the chunks to make up the MOF, got %d of %d bytes", len(comm.uploads[remoteMof]), len(mof))
+	}
+	chunks := 0
+	for _, command := range comm.Commands {
+		if m := appendChunkRegexp.FindStringSubmatch(command); m != nil && m[2] == remoteMof {
+			chunks++
+		}
+	}
+	if chunks != 3 {
+		t.Fatalf("Expected 3 chunks but got %d", chunks)
+	}
+
+	// Files over the threshold are always chunked
+	chunkedUploadThreshold = 1024
+	defer func() { chunkedUploadThreshold = 10 * 1024 * 1024 }()
+	config["chunked_upload"] = false
+	comm = new(testCommunicator)
+	p = new(Provisioner)
+	err = p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	err = p.Provision(ui, comm)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !comm.ran(remoteMof + ".part") {
+		t.Fatal("Expected a file over the threshold to be chunked")
+	}
+
+	// A failed append is retried without repeating the chunk
+	retryableSleep = 1 * time.Millisecond
+	defer func() { retryableSleep = 2 * time.Second }()
+	config["chunked_upload"] = true
+	comm = &testCommunicator{FailAppends: 1}
+	p = new(Provisioner)
+	err = p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	err = p.Provision(ui, comm)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !bytes.Equal(comm.uploads[remoteMof], mof) {
+		t.Fatalf("Expected the chunks to make up the MOF, got %d of %d bytes", len(comm.uploads[remoteMof]), len(mof))
+	}
+}
+
+func TestProvisionerProvision_chunkedUploadManifest(t *testing.T) {
+	tf, err := ioutil.TempFile("", "packer")
+	if err != nil {
+		t.Fatalf("error tempfile: %s", err)
+	}
+	defer os.Remove(tf.Name())
+
+	// Over the threshold once its line endings are converted
+	chunkedUploadThreshold = 2 * int64(uploadChunkSize)
+	defer func() { chunkedUploadThreshold = 10 * 1024 * 1024 }()
+	manifest := bytes.Repeat([]byte("# padding\n"), 2*uploadChunkSize/10)
+	tf.Write(manifest)
+	tf.Close()
+
+	config := testConfig()
+	config["manifest_file"] = tf.Name()
+	ui := &packer.MachineReadableUi{
+		Writer: ioutil.Discard,
+	}
+	comm := new(testCommunicator)
+
+	p := new(Provisioner)
+	err = p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	err = p.Provision(ui, comm)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	remoteManifest := "/tmp/packer-dsc-pull/manifest/" + filepath.Base(tf.Name())
+	if !comm.ran(remoteManifest + ".part") {
+		t.Fatalf("Expected the manifest to be chunked, but commands were: %v", comm.Commands)
+	}
+	if !bytes.Equal(comm.uploads[remoteManifest], windowsLineEndings(manifest)) {
+		t.Fatalf("Expected the chunks to make up the manifest, got %d bytes", len(comm.uploads[remoteManifest]))
+	}
+}
+
+func TestProgressReader(t *testing.T) {
+	var out bytes.Buffer
+	ui := &packer.BasicUi{
+		Reader: new(bytes.Buffer),
+		Writer: &out,
+	}
+
+	r := &progressReader{
+		r:     bytes.NewReader(make([]byte, 100)),
+		ui:    ui,
+		name:  "/tmp/localhost.mof",
+		total: 100,
+	}
+	buf := make([]byte, 25)
+	for {
+		if _, err := r.Read(buf); err == io.EOF {
+			break
+		}
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("Expected progress for each quarter but got:\n%s", out.String())
+	}
+	if lines[3] != "Uploading /tmp/localhost.mof: 100% (100 of 100 bytes)" {
+		t.Fatalf("Expected the upload to complete but got: %s", lines[3])
+	}
+}
+
+func TestProvisionerProvision_clearPendingConfiguration(t *testing.T) {
+	config := testConfig()
+	ui := &packer.MachineReadableUi{
+		Writer: ioutil.Discard,
+	}
+
+	// Not cleared by default
+	comm := new(testCommunicator)
+	p := new(Provisioner)
+	err := p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	err = p.Provision(ui, comm)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if comm.ran("packer-dsc-clear") {
+		t.Fatal("Expected the pending configuration to be kept")
+	}
+
+	config["clear_pending_configuration"] = true
+	comm = new(testCommunicator)
+	p = new(Provisioner)
+	err = p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	err = p.Provision(ui, comm)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	cleared, ran := -1, -1
+	for i, command := range comm.Commands {
+		if strings.Contains(command, "packer-dsc-clear") {
+			cleared = i
+		}
+		if strings.Contains(command, "packer-dsc-runner") {
+			ran = i
+		}
+	}
+	if cleared == -1 || cleared > ran {
+		t.Fatalf("Expected the pending configuration to be cleared before DSC runs, commands were: %v", comm.Commands)
+	}
+
+	comm = &testCommunicator{
+		ExitStatuses: map[string]int{"packer-dsc-clear": 1},
+	}
+	err = p.Provision(ui, comm)
+	if err == nil || !strings.Contains(err.Error(), "Error clearing pending configuration") {
+		t.Fatalf("Expected clear error but got: %v", err)
+	}
+}
+
+func TestProvisionerProvision_preflight(t *testing.T) {
+	config := testConfig()
+	ui := &packer.MachineReadableUi{
+		Writer: ioutil.Discard,
+	}
+	comm := &testCommunicator{
+		Stdout: map[string]string{"PSDesiredStateConfiguration": "Missing\r\n"},
+	}
+
+	p := new(Provisioner)
+	err := p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	err = p.Provision(ui, comm)
+	if err == nil || !strings.Contains(err.Error(), "The PSDesiredStateConfiguration module is not available") {
+		t.Fatalf("Expected missing DSC error but got: %v", err)
+	}
+	if len(comm.Commands) != 1 {
+		t.Fatalf("Expected only the pre-flight check to run, but commands were: %v", comm.Commands)
+	}
+
+	config["skip_preflight"] = true
+	comm.Commands = nil
+	p = new(Provisioner)
+	err = p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	err = p.Provision(ui, comm)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if comm.ran("PSDesiredStateConfiguration") {
+		t.Fatal("Expected the pre-flight check to be skipped")
+	}
+}
+
+func TestProvisionerProvision_preApply(t *testing.T) {
+	tf, err := ioutil.TempFile("", "packer")
+	if err != nil {
+		t.Fatalf("error tempfile: %s", err)
+	}
+	defer os.Remove(tf.Name())
+	tf.WriteString("Set-ItemProperty -Path HKLM:\\Software\\Test -Name Ready -Value 1")
+	tf.Close()
+
+	config := testConfig()
+	config["pre_apply_inline"] = []string{"Stop-Service Spooler", "Set-Service Spooler -StartupType Disabled"}
+	config["pre_apply_script"] = tf.Name()
+	ui := &packer.MachineReadableUi{
+		Writer: ioutil.Discard,
+	}
+	comm := new(testCommunicator)
+
+	p := new(Provisioner)
+	err = p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	err = p.Provision(ui, comm)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	var hooks []string
+	for path, data := range comm.uploads {
+		if strings.Contains(path, "packer-dsc-hook") {
+			hooks = append(hooks, string(data))
+		}
+	}
+	if len(hooks) != 2 {
+		t.Fatalf("Expected 2 hooks to be uploaded but got: %v", hooks)
+	}
+	joined := strings.Join(hooks, "\n")
+	if !strings.Contains(joined, "Stop-Service Spooler\nSet-Service Spooler -StartupType Disabled") ||
+		!strings.Contains(joined, "Set-ItemProperty -Path HKLM:\\Software\\Test") {
+		t.Fatalf("Expected the hooks to be run but got: %v", hooks)
+	}
+
+	hook, installed := -1, -1
+	for i, command := range comm.Commands {
+		if strings.Contains(command, "packer-dsc-hook") && hook == -1 {
+			hook = i
+		}
+		if strings.Contains(command, "packer-dsc-packagemanagement") {
+			installed = i
+		}
+	}
+	if hook == -1 || hook > installed {
+		t.Fatalf("Expected the hooks to run before anything is installed, commands were: %v", comm.Commands)
+	}
+
+	// A failing hook stops the build before DSC is run
+	comm = &testCommunicator{
+		ExitStatuses: map[string]int{"packer-dsc-hook": 1},
+	}
+	err = p.Provision(ui, comm)
+	if err == nil || !strings.Contains(err.Error(), "Error running pre-apply hook") {
+		t.Fatalf("Expected hook error but got: %v", err)
+	}
+	if comm.ran("packer-dsc-runner") {
+		t.Fatal("Expected DSC not to run after a failed hook")
+	}
+
+	config["pre_apply_script"] = "i/do/not/exist.ps1"
+	p = new(Provisioner)
+	err = p.Prepare(config)
+	if err == nil {
+		t.Fatal("should have error")
+	}
+}
+
+func TestProvisionerProvision_validExitCodes(t *testing.T) {
+	config := testConfig()
+	config["report_status"] = false
+	ui := &packer.MachineReadableUi{
+		Writer: ioutil.Discard,
+	}
+
+	// 0 and 2 by default
+	p := new(Provisioner)
+	err := p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	comm := &testCommunicator{
+		ExitStatuses: map[string]int{"packer-dsc-runner": 2},
+	}
+	if err := p.Provision(ui, comm); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	comm = &testCommunicator{
+		ExitStatuses: map[string]int{"packer-dsc-runner": 3010},
+	}
+	if err := p.Provision(ui, comm); err == nil {
+		t.Fatal("Expected exit status 3010 to fail")
+	}
+
+	config["valid_exit_codes"] = []int{0, 3010}
+	p = new(Provisioner)
+	err = p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := p.Provision(ui, comm); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	comm = &testCommunicator{
+		ExitStatuses: map[string]int{"packer-dsc-runner": 2},
+	}
+	err = p.Provision(ui, comm)
+	if err == nil || !strings.Contains(err.Error(), "DSC exited with a non-zero exit status: 2") {
+		t.Fatalf("Expected exit status error but got: %v", err)
+	}
+
+	config["ignore_exit_codes"] = true
+	p = new(Provisioner)
+	err = p.Prepare(config)
+	if err == nil || !strings.Contains(err.Error(), "valid_exit_codes cannot be used with ignore_exit_codes") {
+		t.Fatalf("Expected ignore_exit_codes conflict but got: %v", err)
+	}
+}
+
+func TestProvisionerProvision_verifyAfterApply(t *testing.T) {
+	config := testConfig()
+	ui := &packer.MachineReadableUi{
+		Writer: ioutil.Discard,
+	}
+
+	// Not verified by default
+	comm := new(testCommunicator)
+	p := new(Provisioner)
+	err := p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	err = p.Provision(ui, comm)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if comm.ran("packer-dsc-verify") {
+		t.Fatal("Expected the configuration not to be verified")
+	}
+
+	config["verify_after_apply"] = true
+	comm = new(testCommunicator)
+	p = new(Provisioner)
+	err = p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	err = p.Provision(ui, comm)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !comm.ran("packer-dsc-verify") {
+		t.Fatalf("Expected the configuration to be verified, commands were: %v", comm.Commands)
+	}
+
+	comm = &testCommunicator{
+		ExitStatuses: map[string]int{"packer-dsc-verify": 1},
+	}
+	err = p.Provision(ui, comm)
+	if err == nil || !strings.Contains(err.Error(), "not in the desired state") {
+		t.Fatalf("Expected verification error but got: %v", err)
+	}
+}
+
+func TestProvisionerProvision_failIfNoChanges(t *testing.T) {
+	config := testConfig()
+	var out bytes.Buffer
+	ui := &packer.MachineReadableUi{
+		Writer: &out,
+	}
+
+	comm := &testCommunicator{
+		Stdout: map[string]string{"'NoChanges'": "NoChanges\r\n"},
+	}
+	p := new(Provisioner)
+	err := p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	err = p.Provision(ui, comm)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !strings.Contains(out.String(), "System already in desired state") {
+		t.Fatalf("Expected the no-op to be reported but got:\n\n%s", out.String())
+	}
+
+	config["fail_if_no_changes"] = true
+	p = new(Provisioner)
+	err = p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	err = p.Provision(ui, comm)
+	if err == nil || !strings.Contains(err.Error(), "DSC made no changes") {
+		t.Fatalf("Expected no changes error but got: %v", err)
+	}
+
+	comm = &testCommunicator{
+		Stdout: map[string]string{"'NoChanges'": "Changes\r\n"},
+	}
+	err = p.Provision(ui, comm)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if p.summary.Changed == nil || !*p.summary.Changed {
+		t.Fatalf("Expected the changes to be recorded but got: %v", p.summary.Changed)
+	}
+
+	config["what_if"] = true
+	p = new(Provisioner)
+	err = p.Prepare(config)
+	if err == nil || !strings.Contains(err.Error(), "fail_if_no_changes cannot be used with what_if") {
+		t.Fatalf("Expected what_if error but got: %v", err)
+	}
+}
+
+func TestProvisionerProvision_statusOutputFormat(t *testing.T) {
+	config := testConfig()
+	config["status_output_format"] = "json"
+	ui := &packer.MachineReadableUi{
+		Writer: ioutil.Discard,
+	}
+	comm := new(testCommunicator)
+
+	p := new(Provisioner)
+	err := p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	err = p.Provision(ui, comm)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	reported := false
+	for path, data := range comm.uploads {
+		if strings.Contains(path, "packer-dsc-status") {
+			reported = strings.Contains(string(data), "$status | ConvertTo-Json -Depth 4")
+		}
+	}
+	if !reported {
+		t.Fatal("Expected the status to be reported as JSON")
+	}
+
+	config["status_output_format"] = "xml"
+	p = new(Provisioner)
+	err = p.Prepare(config)
+	if err == nil {
+		t.Fatal("should have error")
+	}
+}
+
+// hookIndex returns the index of the command which ran the hook script
+// containing marker, or -1 if it wasn't run
+func hookIndex(comm *testCommunicator, marker string) int {
+	for i, command := range comm.Commands {
+		for path, data := range comm.uploads {
+			if strings.Contains(path, "packer-dsc-hook") && strings.Contains(command, path) && strings.Contains(string(data), marker) {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+func TestProvisionerProvision_executeHooks(t *testing.T) {
+	config := testConfig()
+	config["pre_execute_command"] = "net use Z: \\\\server\\share"
+	config["post_execute_command"] = "net use Z: /delete"
+	ui := &packer.MachineReadableUi{
+		Writer: ioutil.Discard,
+	}
+	comm := new(testCommunicator)
+
+	p := new(Provisioner)
+	err := p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	err = p.Provision(ui, comm)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	pre, post := hookIndex(comm, "net use Z: \\\\server"), hookIndex(comm, "net use Z: /delete")
+	ran := -1
+	for i, command := range comm.Commands {
+		if strings.Contains(command, "packer-dsc-runner") {
+			ran = i
+		}
+	}
+	if pre == -1 || post == -1 || !(pre < ran && ran < post) {
+		t.Fatalf("Expected the hooks to run either side of DSC, commands were: %v", comm.Commands)
+	}
+
+	// The post command isn't run when DSC fails
+	comm = &testCommunicator{
+		ExitStatuses: map[string]int{"packer-dsc-runner": 1},
+	}
+	err = p.Provision(ui, comm)
+	if err == nil || !strings.Contains(err.Error(), "DSC exited with a non-zero exit status") {
+		t.Fatalf("Expected DSC error but got: %v", err)
+	}
+	if hookIndex(comm, "net use Z: /delete") != -1 {
+		t.Fatal("Expected post_execute_command not to run after a failure")
+	}
+
+	// Unless run_post_on_failure is set, keeping the DSC error
+	config["run_post_on_failure"] = true
+	p = new(Provisioner)
+	err = p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	comm = &testCommunicator{
+		ExitStatuses: map[string]int{"packer-dsc-runner": 1},
+	}
+	err = p.Provision(ui, comm)
+	if err == nil || !strings.Contains(err.Error(), "DSC exited with a non-zero exit status") {
+		t.Fatalf("Expected DSC error but got: %v", err)
+	}
+	if hookIndex(comm, "net use Z: /delete") == -1 {
+		t.Fatal("Expected post_execute_command to run after a failure")
+	}
+
+	// A failing hook fails the provisioner
+	comm = &testCommunicator{
+		ExitStatuses: map[string]int{"packer-dsc-hook": 1},
+	}
+	err = p.Provision(ui, comm)
+	if err == nil || !strings.Contains(err.Error(), "Error running pre_execute_command") {
+		t.Fatalf("Expected hook error but got: %v", err)
+	}
+}
+
+func TestProvisionerProvision_executeHooksManifestFiles(t *testing.T) {
+	td, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	defer os.RemoveAll(td)
+
+	var manifests []string
+	for _, name := range []string{"Base", "WebServer"} {
+		path := filepath.Join(td, name+".ps1")
+		if err := ioutil.WriteFile(path, []byte("Configuration "+name+" {}"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		manifests = append(manifests, path)
+	}
+
+	config := testConfig()
+	delete(config, "manifest_file")
+	config["manifest_files"] = manifests
+	config["pre_execute_command"] = "net use Z: \\\\server\\share"
+	config["post_execute_command"] = "net use Z: /delete"
+	ui := &packer.MachineReadableUi{
+		Writer: ioutil.Discard,
+	}
+	comm := new(testCommunicator)
+
+	p := new(Provisioner)
+	err = p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	err = p.Provision(ui, comm)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The hooks run once, before the first Configuration and after the last
+	var pre, post, runners []int
+	for i, command := range comm.Commands {
+		if strings.Contains(command, "packer-dsc-runner") {
+			runners = append(runners, i)
+		}
+		for path, data := range comm.uploads {
+			if strings.Contains(path, "packer-dsc-hook") && strings.Contains(command, path) {
+				if strings.Contains(string(data), "net use Z: \\\\server") {
+					pre = append(pre, i)
+				}
+				if strings.Contains(string(data), "net use Z: /delete") {
+					post = append(post, i)
+				}
+			}
+		}
+	}
+	if len(pre) != 1 || len(post) != 1 || len(runners) != 2 {
+		t.Fatalf("Expected each hook to run once, commands were: %v", comm.Commands)
+	}
+	if !(pre[0] < runners[0] && runners[1] < post[0]) {
+		t.Fatalf("Expected the hooks to run either side of every Configuration, commands were: %v", comm.Commands)
+	}
+}
+
+func TestProvisionerProvision_inlineManifest(t *testing.T) {
+	config := testConfig()
+	delete(config, "manifest_file")
+	config["inline_manifest"] = "Configuration Inline {\n  Node localhost {}\n}"
+	ui := &packer.MachineReadableUi{
+		Writer: ioutil.Discard,
+	}
+	comm := new(testCommunicator)
+
+	// The Configuration can't be named after the file
+	p := new(Provisioner)
+	err := p.Prepare(config)
+	if err == nil || !strings.Contains(err.Error(), "A configuration_name must be specified with inline_manifest.") {
+		t.Fatalf("Expected configuration_name error but got: %v", err)
+	}
+
+	config["configuration_name"] = "Inline"
+	p = new(Provisioner)
+	err = p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	err = p.Provision(ui, comm)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	manifest := string(comm.uploads["/tmp/packer-dsc-pull/manifest/Inline.ps1"])
+	if manifest != "Configuration Inline {\r\n  Node localhost {}\r\n}" {
+		t.Fatalf("Expected the inline manifest to be uploaded but got: %q", manifest)
+	}
+
+	runner := runnerScript(t, comm)
+	if !strings.Contains(runner, `$script = $("/tmp/packer-dsc-pull/manifest/Inline.ps1" | Resolve-Path)`) ||
+		!strings.Contains(runner, "Inline -OutputPath $StagingPath") {
+		t.Fatalf("Expected the inline manifest to be applied, runner was:\n%s", runner)
+	}
+}
+
+func TestProvisionerProvision_outputJSON(t *testing.T) {
+	td, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	defer os.RemoveAll(td)
+
+	config := testConfig()
+	config["output_json"] = td + "/summary.json"
+	config["verify_after_apply"] = true
+	config["clean_staging_dir"] = true
+	ui := &packer.MachineReadableUi{
+		Writer: ioutil.Discard,
+	}
+	comm := new(testCommunicator)
+
+	p := new(Provisioner)
+	err = p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	err = p.Provision(ui, comm)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	var summary provisionSummary
+	data, err := ioutil.ReadFile(td + "/summary.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &summary); err != nil {
+		t.Fatalf("Expected the summary to be JSON: %s", err)
+	}
+	if !summary.Success || summary.ExitStatus != 0 || summary.InDesiredState == nil || !*summary.InDesiredState {
+		t.Fatalf("Expected a successful summary but got: %s", data)
+	}
+	runner := false
+	for _, script := range summary.Scripts {
+		runner = runner || strings.Contains(script, "packer-dsc-runner")
+	}
+	if !runner {
+		t.Fatalf("Expected the DSC runner to be listed but got: %v", summary.Scripts)
+	}
+
+	// Failures are summarised too
+	comm = &testCommunicator{
+		ExitStatuses: map[string]int{"packer-dsc-runner": 3},
+	}
+	err = p.Provision(ui, comm)
+	if err == nil {
+		t.Fatal("Expected error but got none")
+	}
+
+	summary = provisionSummary{}
+	data, err = ioutil.ReadFile(td + "/summary.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &summary); err != nil {
+		t.Fatalf("Expected the summary to be JSON: %s", err)
+	}
+	if summary.Success || summary.ExitStatus != 3 || !strings.Contains(summary.Error, "non-zero exit status") {
+		t.Fatalf("Expected a failed summary but got: %s", data)
+	}
+}
+
+func TestProvisionerProvision_sensitiveVars(t *testing.T) {
+	config := testConfig()
+	config["debug"] = true
+	config["log_level"] = "debug"
+	config["environment_vars"] = []string{"DB_PASSWORD=hunter2", "DB_USER=admin"}
+	config["configuration_params"] = map[string]string{
+		"-AdminPassword": "it's s3cr3t",
+	}
+	config["sensitive_vars"] = []string{"DB_PASSWORD", "AdminPassword"}
+	ui := &packer.MachineReadableUi{
+		Writer: ioutil.Discard,
+	}
+	comm := new(testCommunicator)
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	p := new(Provisioner)
+	err := p.Prepare(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	err = p.Provision(ui, comm)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	for _, secret := range []string{"hunter2", "s3cr3t"} {
+		if strings.Contains(logs.String(), secret) {
+			t.Fatalf("Expected '%s' to be redacted from the log:\n\n%s", secret, logs.String())
+		}
+	}
+	if !strings.Contains(logs.String(), "$env:DB_PASSWORD = '****'") || !strings.Contains(logs.String(), "$env:DB_USER = 'admin'") {
+		t.Fatalf("Expected only sensitive values to be redacted:\n\n%s", logs.String())
+	}
+
+	// The values are still passed to DSC
+	runner := runnerScript(t, comm)
+	if !strings.Contains(runner, "$env:DB_PASSWORD = 'hunter2'") || !strings.Contains(runner, "-AdminPassword 'it''s s3cr3t'") {
+		t.Fatalf("Expected the runner to contain the sensitive values, runner was:\n%s", runner)
+	}
 }
@@ -0,0 +1,133 @@
+package dsc
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/packer/packer"
+)
+
+// The maximum number of reboots DSC may request during a single run
+const maxDscReboots = 10
+
+// Waits for the LCM to finish any in-flight work, then reports its state
+var lcmStateScript = `while ((Get-DscLocalConfigurationManager).LCMState -eq 'Busy') { Start-Sleep -Seconds 5 }; (Get-DscLocalConfigurationManager).LCMState`
+
+var bootTimeScript = `(Get-WmiObject Win32_OperatingSystem).LastBootUpTime`
+
+var restartCommand = `shutdown /r /f /t 0 /c "packer dsc restart"`
+
+var resumeScript = `Start-DscConfiguration -UseExisting -Force -Wait`
+
+var verifyScript = `if (-not (Test-DscConfiguration)) { exit 1 }`
+
+// handleReboots restarts the machine while the LCM reports a pending
+// reboot, resuming the Configuration once the machine is available again.
+//
+// The returned command is the last DSC command run, whose exit status
+// determines the outcome of the Configuration.
+func (p *Provisioner) handleReboots(ctx context.Context, ui packer.Ui, comm packer.Communicator, cmd *packer.RemoteCmd) (*packer.RemoteCmd, error) {
+	rebooted := cmd.ExitStatus == packer.CmdDisconnect
+	for i := 0; ; i++ {
+		var state string
+		err := p.retryable(ctx, func() error {
+			var err error
+			state, err = p.remoteOutput(ctx, comm, p.powershellCommand(lcmStateScript))
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		switch state {
+		case "PendingReboot":
+			if i == maxDscReboots {
+				return nil, fmt.Errorf("DSC requested more than %d reboots", maxDscReboots)
+			}
+			ui.Say("DSC requested a reboot, restarting the machine...")
+			if err := p.restart(ctx, comm); err != nil {
+				return nil, err
+			}
+			p.summary.Reboots++
+			rebooted = true
+		case "PendingConfiguration":
+			ui.Message("Resuming DSC Configuration...")
+			resume := resumeScript
+			if p.config.Verbose {
+				resume += " -Verbose"
+			}
+			cmd = &packer.RemoteCmd{Command: p.powershellCommand(resume)}
+			if err := p.runCommand(ctx, ui, comm, cmd); err != nil {
+				return nil, err
+			}
+		default:
+			if !rebooted {
+				return cmd, nil
+			}
+
+			ui.Message("Verifying DSC Configuration after reboot...")
+			err := p.retryable(ctx, func() error {
+				cmd = &packer.RemoteCmd{Command: p.powershellCommand(verifyScript)}
+				return p.runCommand(ctx, ui, comm, cmd)
+			})
+			return cmd, err
+		}
+	}
+}
+
+// restart the remote machine, waiting until it has come back up
+func (p *Provisioner) restart(ctx context.Context, comm packer.Communicator) error {
+	var bootTime string
+	err := p.retryable(ctx, func() error {
+		var err error
+		bootTime, err = p.remoteOutput(ctx, comm, p.powershellCommand(bootTimeScript))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	// The connection is likely to drop before the command completes
+	cmd := &packer.RemoteCmd{Command: restartCommand}
+	if err := comm.Start(cmd); err == nil {
+		waitCommand(ctx, cmd)
+	} else {
+		p.logf("warn", "Error starting restart, the machine may already be restarting: %s", err)
+	}
+
+	return p.retryable(ctx, func() error {
+		current, err := p.remoteOutput(ctx, comm, p.powershellCommand(bootTimeScript))
+		if err != nil {
+			return err
+		}
+		if current == bootTime {
+			return fmt.Errorf("Machine has not restarted yet")
+		}
+		return nil
+	})
+}
+
+// remoteOutput runs the command on the remote host, returning its output
+func (p *Provisioner) remoteOutput(ctx context.Context, comm packer.Communicator, command string) (string, error) {
+	var stdout bytes.Buffer
+	cmd := &packer.RemoteCmd{
+		Command: command,
+		Stdout:  &stdout,
+	}
+
+	p.logf("debug", "Running remote command: %s", command)
+	if err := comm.Start(cmd); err != nil {
+		return "", p.communicatorError(fmt.Errorf("Error starting remote command '%s': %s", command, err))
+	}
+	if err := waitCommand(ctx, cmd); err != nil {
+		return "", err
+	}
+
+	if cmd.ExitStatus != 0 {
+		return "", fmt.Errorf("%s exited with a non-zero exit status: %d", command, cmd.ExitStatus)
+	}
+
+	return strings.TrimSpace(stdout.String()), nil
+}
@@ -0,0 +1,277 @@
+package dsc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/hashicorp/packer/packer"
+)
+
+// Template to report the status of the last DSC Configuration run,
+// exiting non-zero if it failed
+var statusTemplate = `
+$status = Get-DscConfigurationStatus -ErrorAction SilentlyContinue
+if ($status -eq $null) {
+	Write-Output "No DSC configuration status is available"
+	exit 0
+}
+
+Write-Output "Status: $($status.Status)"
+Write-Output "Duration: $($status.DurationInSeconds) seconds"
+Write-Output "Resources in desired state: $(@($status.ResourcesInDesiredState).Count)"
+Write-Output "Resources not in desired state: $(@($status.ResourcesNotInDesiredState).Count)"
+$status.ResourcesNotInDesiredState | Where-Object { $_ -ne $null } | ForEach-Object {
+	Write-Output "  $($_.ResourceId): $($_.Error)"
+}
+if ($status.Error) {
+	Write-Output "Error: $($status.Error)"
+}
+if ($status.RebootRequested) {
+	Write-Output "A reboot was requested"
+}
+
+if ($status.Status -eq "Failure") {
+	exit 1
+}
+exit 0
+`
+
+// Template to test the node is in the desired state, listing the
+// resources which aren't and exiting non-zero if any
+var verifyTemplate = `
+$result = Test-DscConfiguration -Detailed
+if (-not $result.InDesiredState) {
+	Write-Output "Resources not in desired state:"
+	$result.ResourcesNotInDesiredState | Where-Object { $_ -ne $null } | ForEach-Object {
+		Write-Output "  $($_.ResourceId)"
+	}
+	exit 1
+}
+Write-Output "All resources are in the desired state"
+exit 0
+`
+
+// Outputs whether the last DSC Configuration run made changes. The
+// resources DSC had to set are reported as not in the desired state,
+// even once they have been set successfully.
+var changesScript = `$status = Get-DscConfigurationStatus -ErrorAction SilentlyContinue; if ($status -eq $null) { 'Unknown' } elseif (@($status.ResourcesNotInDesiredState | Where-Object { $_ -ne $null }).Count -eq 0) { 'NoChanges' } else { 'Changes' }`
+
+// Template to report the status of the last DSC Configuration run as
+// JSON, exiting non-zero if it failed
+var statusJSONTemplate = `
+$status = Get-DscConfigurationStatus -ErrorAction SilentlyContinue
+if ($status -eq $null) {
+	Write-Output "null"
+	exit 0
+}
+
+$status | ConvertTo-Json -Depth 4
+if ($status.Status -eq "Failure") {
+	exit 1
+}
+exit 0
+`
+
+// Template to write the status of the last DSC Configuration run as JSON
+// to the given remote path, without a byte order mark
+var reportTemplate = `
+$status = Get-DscConfigurationStatus
+$json = $status | ConvertTo-Json -Depth 4
+[IO.File]::WriteAllText('%s', $json)
+`
+
+// Template to write the current state of the resources in the applied
+// Configuration as JSON to the given remote path. Get-DscConfiguration
+// throws if no Configuration has been applied, which exits with
+// noStateExitStatus.
+var stateTemplate = `
+try {
+	$state = Get-DscConfiguration -ErrorAction Stop
+} catch {
+	Write-Output $_.Exception.Message
+	exit 2
+}
+$json = $state | ConvertTo-Json -Depth 4
+[IO.File]::WriteAllText('%s', $json)
+`
+
+// The exit status of stateTemplate when there is no state to save
+const noStateExitStatus = 2
+
+// saveReport downloads the status of the last DSC Configuration run as
+// JSON to report_path, as a record of what was applied to the image.
+func (p *Provisioner) saveReport(ctx context.Context, ui packer.Ui, comm packer.Communicator) error {
+	ui.Message(fmt.Sprintf("Saving DSC configuration report to %s", p.config.ReportPath))
+
+	remoteReportPath := fmt.Sprintf("%s/dsc-report.json", p.config.StagingDir)
+	p.trackRemotePath(remoteReportPath)
+	script := fmt.Sprintf(reportTemplate, singleQuoteEscaper.Replace(remoteReportPath))
+	cmd, err := p.runScript(ctx, ui, comm, script, "packer-dsc-report")
+	if err != nil {
+		return err
+	}
+	if cmd.ExitStatus != 0 {
+		return exitError("Get-DscConfigurationStatus", cmd)
+	}
+
+	f, err := os.Create(p.config.ReportPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return comm.Download(remoteReportPath, f)
+}
+
+// saveState downloads the current state of the resources in the applied
+// Configuration, as reported by Get-DscConfiguration, as JSON to
+// state_path, so that it can be compared across builds. If there is no
+// state, a warning is shown rather than failing.
+func (p *Provisioner) saveState(ctx context.Context, ui packer.Ui, comm packer.Communicator) error {
+	ui.Message(fmt.Sprintf("Saving DSC configuration state to %s", p.config.StatePath))
+
+	remoteStatePath := fmt.Sprintf("%s/dsc-state.json", p.config.StagingDir)
+	p.trackRemotePath(remoteStatePath)
+	script := fmt.Sprintf(stateTemplate, singleQuoteEscaper.Replace(remoteStatePath))
+	cmd, err := p.runScript(ctx, ui, comm, script, "packer-dsc-state")
+	if err != nil {
+		return err
+	}
+	if cmd.ExitStatus == noStateExitStatus {
+		ui.Say("Warning: Get-DscConfiguration reported no configuration state, so none was saved")
+		return nil
+	}
+	if cmd.ExitStatus != 0 {
+		return exitError("Get-DscConfiguration", cmd)
+	}
+
+	f, err := os.Create(p.config.StatePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return comm.Download(remoteStatePath, f)
+}
+
+// reportStatus reports the outcome of the last DSC Configuration run
+// using Get-DscConfigurationStatus. DSC may report failed resources
+// without Start-DscConfiguration exiting non-zero, so a failed status
+// is returned as an error.
+func (p *Provisioner) reportStatus(ctx context.Context, ui packer.Ui, comm packer.Communicator) error {
+	ui.Say("Reporting DSC configuration status...")
+
+	script := statusTemplate
+	if p.config.StatusOutputFormat == "json" {
+		script = statusJSONTemplate
+	}
+
+	cmd, err := p.runScript(ctx, ui, comm, script, "packer-dsc-status")
+	if err != nil {
+		return err
+	}
+
+	if cmd.ExitStatus != 0 && !p.config.IgnoreExitCodes {
+		return fmt.Errorf("DSC reported a failed configuration status (exit status: %d)", cmd.ExitStatus)
+	}
+
+	return nil
+}
+
+// verifyConfiguration fails if Test-DscConfiguration reports the node
+// isn't in the desired state, which DSC doesn't always catch when
+// applying the Configuration.
+func (p *Provisioner) verifyConfiguration(ctx context.Context, ui packer.Ui, comm packer.Communicator) error {
+	ui.Say("Verifying the node is in the desired state...")
+
+	cmd, err := p.runScript(ctx, ui, comm, verifyTemplate, "packer-dsc-verify")
+	if err != nil {
+		return err
+	}
+
+	inDesiredState := cmd.ExitStatus == 0
+	p.summary.InDesiredState = &inDesiredState
+
+	if cmd.ExitStatus != 0 {
+		return fmt.Errorf("Test-DscConfiguration reported the node is not in the desired state (exit status: %d)", cmd.ExitStatus)
+	}
+
+	return nil
+}
+
+// checkChanges reports when the last DSC Configuration run made no
+// changes. The summary records changes if any of the runs so far made
+// them. If the status of the run isn't available, only a warning is
+// logged.
+func (p *Provisioner) checkChanges(ctx context.Context, ui packer.Ui, comm packer.Communicator) error {
+	output, err := p.remoteOutput(ctx, comm, p.powershellCommand(changesScript))
+	if err != nil {
+		return err
+	}
+
+	switch output {
+	case "NoChanges":
+		ui.Message("System already in desired state")
+		if p.summary.Changed == nil {
+			changed := false
+			p.summary.Changed = &changed
+		}
+	case "Changes":
+		changed := true
+		p.summary.Changed = &changed
+	default:
+		p.logf("warn", "Unable to tell whether DSC made any changes: %s", output)
+	}
+
+	return nil
+}
+
+// provisionSummary is the outcome of a Provision, written to output_json
+// for tooling to parse
+type provisionSummary struct {
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+
+	// The scripts uploaded to and run on the remote host
+	Scripts []string `json:"scripts"`
+
+	// The exit status of the DSC runner, after any reboots
+	ExitStatus int `json:"exit_status"`
+	Reboots    int `json:"reboots"`
+
+	// Whether Test-DscConfiguration found the node in the desired
+	// state, only set with verify_after_apply
+	InDesiredState *bool `json:"in_desired_state,omitempty"`
+
+	// Whether DSC made any changes, only set if it could be told
+	Changed *bool `json:"changed,omitempty"`
+
+	WhatIf          bool    `json:"what_if"`
+	DurationSeconds float64 `json:"duration_seconds"`
+}
+
+// writeSummary writes the summary of the Provision started at start,
+// which ended with err, to output_json
+func (p *Provisioner) writeSummary(start time.Time, err error) error {
+	summary := p.summary
+	summary.Success = err == nil
+	if err != nil {
+		summary.Error = err.Error()
+	}
+	if summary.Scripts == nil {
+		summary.Scripts = []string{}
+	}
+	summary.WhatIf = p.config.WhatIf
+	summary.DurationSeconds = time.Since(start).Seconds()
+
+	data, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(p.config.OutputJSON, data, 0644)
+}
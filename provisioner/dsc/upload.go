@@ -0,0 +1,227 @@
+package dsc
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/hashicorp/packer/packer"
+)
+
+// Outputs the SHA256 hash of the given remote file
+var fileHashTemplate = `(Get-FileHash -Algorithm SHA256 -Path '%s').Hash`
+
+// Files larger than this are uploaded in chunks
+var chunkedUploadThreshold int64 = 10 * 1024 * 1024
+
+// The size of each chunk of a chunked upload
+var uploadChunkSize = 1024 * 1024
+
+// Uploads larger than this report their progress
+var uploadProgressThreshold = 1024 * 1024
+
+// Writes the uploaded chunk to the file being uploaded at the given
+// offset, creating it for the first chunk, then removes the chunk. The
+// file is truncated to the offset first, so that appending a chunk again
+// doesn't repeat it.
+var appendChunkTemplate = `try { $b = [IO.File]::ReadAllBytes('%s'); $f = [IO.File]::Open('%s', 'OpenOrCreate'); $f.SetLength(%d); $f.Seek(0, 'End') | Out-Null; $f.Write($b, 0, $b.Length); $f.Close(); Remove-Item '%s' } catch { exit 1 }`
+
+// uploadFile uploads the local file src to dst on the remote host
+func (p *Provisioner) uploadFile(ctx context.Context, ui packer.Ui, comm packer.Communicator, dst string, src string) error {
+	p.trackRemotePath(dst)
+
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if p.config.ChunkedUpload || info.Size() > chunkedUploadThreshold {
+		f, err := os.Open(src)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		return p.uploadChunked(ctx, ui, comm, dst, f, info.Size())
+	}
+
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+
+	return p.upload(ctx, ui, comm, dst, data)
+}
+
+// uploadScript uploads the local text file src to dst on the remote
+// host, converting its line endings to CRLF unless binary is set.
+func (p *Provisioner) uploadScript(ctx context.Context, ui packer.Ui, comm packer.Communicator, dst string, src string) error {
+	p.trackRemotePath(dst)
+
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+
+	return p.uploadScriptData(ctx, ui, comm, dst, data)
+}
+
+// uploadScriptData uploads the text data to dst on the remote host,
+// converting its line endings to CRLF unless binary is set.
+func (p *Provisioner) uploadScriptData(ctx context.Context, ui packer.Ui, comm packer.Communicator, dst string, data []byte) error {
+	if !p.config.Binary {
+		data = windowsLineEndings(data)
+	}
+
+	if p.config.ChunkedUpload || int64(len(data)) > chunkedUploadThreshold {
+		return p.uploadChunked(ctx, ui, comm, dst, bytes.NewReader(data), int64(len(data)))
+	}
+
+	return p.upload(ctx, ui, comm, dst, data)
+}
+
+// windowsLineEndings converts the line endings of data to CRLF. UTF-16
+// text, which starts with a byte order mark, is returned unchanged as
+// inserting single bytes would corrupt it.
+func windowsLineEndings(data []byte) []byte {
+	if bytes.HasPrefix(data, []byte{0xFF, 0xFE}) || bytes.HasPrefix(data, []byte{0xFE, 0xFF}) {
+		return data
+	}
+
+	data = bytes.Replace(data, []byte("\r\n"), []byte("\n"), -1)
+	return bytes.Replace(data, []byte("\n"), []byte("\r\n"), -1)
+}
+
+// upload uploads data to dst on the remote host. If verify_upload is
+// enabled, the SHA256 hash of the remote file is compared with that of
+// data, and the upload retried if they differ, so that a truncated or
+// corrupt file is never run.
+//
+// Progress is reported through ui for uploads larger than
+// uploadProgressThreshold, unless ui is nil.
+func (p *Provisioner) upload(ctx context.Context, ui packer.Ui, comm packer.Communicator, dst string, data []byte) error {
+	reader := func() io.Reader {
+		if ui == nil || len(data) <= uploadProgressThreshold {
+			return bytes.NewReader(data)
+		}
+		return &progressReader{r: bytes.NewReader(data), ui: ui, name: dst, total: int64(len(data))}
+	}
+
+	if !p.config.VerifyUpload {
+		return comm.Upload(dst, reader(), nil)
+	}
+
+	sum := sha256.Sum256(data)
+	expected := hex.EncodeToString(sum[:])
+
+	return p.retryable(ctx, func() error {
+		if err := comm.Upload(dst, reader(), nil); err != nil {
+			return p.communicatorError(err)
+		}
+
+		command := p.powershellCommand(fmt.Sprintf(fileHashTemplate, singleQuoteEscaper.Replace(dst)))
+		actual, err := p.remoteOutput(ctx, comm, command)
+		if err != nil {
+			return fmt.Errorf("Error verifying upload of %s: %s", dst, err)
+		}
+
+		if !strings.EqualFold(actual, expected) {
+			return fmt.Errorf("Upload of %s is corrupt: expected SHA256 %s but got %s", dst, expected, actual)
+		}
+
+		return nil
+	})
+}
+
+// uploadChunked uploads the size bytes read from r to dst on the remote
+// host a chunk at a time, so that the whole file is never held in memory
+// and a failure only repeats the upload of a single chunk. Each chunk is
+// uploaded alongside dst, verified if verify_upload is set, and then
+// appended to dst.
+func (p *Provisioner) uploadChunked(ctx context.Context, ui packer.Ui, comm packer.Communicator, dst string, r io.Reader, size int64) error {
+	chunks := (size + int64(uploadChunkSize) - 1) / int64(uploadChunkSize)
+
+	chunkPath := dst + ".part"
+	hash := sha256.New()
+	buf := make([]byte, uploadChunkSize)
+	var offset int64
+	for i := 0; ; i++ {
+		n, err := io.ReadFull(r, buf)
+		if err == io.EOF && i > 0 {
+			break
+		}
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+
+		chunk := buf[:n]
+		hash.Write(chunk)
+		script := fmt.Sprintf(appendChunkTemplate, singleQuoteEscaper.Replace(chunkPath),
+			singleQuoteEscaper.Replace(dst), offset, singleQuoteEscaper.Replace(chunkPath))
+
+		// The chunk is removed once appended, so it is uploaded again
+		// each time the append is retried
+		err = p.retryable(ctx, func() error {
+			// Progress is reported per chunk rather than within each.
+			// upload retries failures itself.
+			if err := p.upload(ctx, nil, comm, chunkPath, chunk); err != nil {
+				return &fatalError{err: err}
+			}
+			_, err := p.remoteOutput(ctx, comm, p.powershellCommand(script))
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("Error appending chunk %d of %s: %s", i+1, dst, err)
+		}
+		offset += int64(n)
+		if chunks > 1 {
+			ui.Message(fmt.Sprintf("Uploaded chunk %d of %d to %s", i+1, chunks, dst))
+		}
+
+		if n < len(buf) {
+			break
+		}
+	}
+
+	if !p.config.VerifyUpload {
+		return nil
+	}
+
+	expected := hex.EncodeToString(hash.Sum(nil))
+	command := p.powershellCommand(fmt.Sprintf(fileHashTemplate, singleQuoteEscaper.Replace(dst)))
+	actual, err := p.remoteOutput(ctx, comm, command)
+	if err != nil {
+		return fmt.Errorf("Error verifying upload of %s: %s", dst, err)
+	}
+	if !strings.EqualFold(actual, expected) {
+		return fmt.Errorf("Upload of %s is corrupt: expected SHA256 %s but got %s", dst, expected, actual)
+	}
+
+	return nil
+}
+
+// progressReader reports the progress of an upload through ui each time
+// another tenth of it has been read.
+type progressReader struct {
+	r     io.Reader
+	ui    packer.Ui
+	name  string
+	total int64
+	read  int64
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	before := r.read * 10 / r.total
+	r.read += int64(n)
+	if after := r.read * 10 / r.total; after > before {
+		r.ui.Message(fmt.Sprintf("Uploading %s: %d%% (%d of %d bytes)",
+			r.name, after*10, r.read, r.total))
+	}
+	return n, err
+}